@@ -12,14 +12,22 @@ type decoder struct {
 }
 
 func Decode(bc string) (map[string]any, error) {
+    dict, _, err := DecodePrefix(bc)
+    return dict, err
+}
+
+// DecodePrefix decodes the dictionary at the start of bc and also returns
+// how many bytes it took, for messages that carry raw data after it.
+func DecodePrefix(bc string) (map[string]any, int, error) {
     d := &decoder{bc, 0}
     if b, err := d.readByte(); err != nil {
-        return make(map[string]any), err
+        return make(map[string]any), 0, err
     } else if b != 'd' {
-        return make(map[string]any),
+        return make(map[string]any), 0,
                 errors.New("failed to read dictionary.")
     }
-    return d.readDict()
+    dict, err := d.readDict()
+    return dict, d.cursor, err
 }
 
 func (d *decoder) readByte() (byte, error) {
@@ -42,26 +50,25 @@ func (d *decoder) unreadByte() error {
 func (d *decoder) readDict() (map[string]any, error) {
     dict := make(map[string]any)
     for {
-        key, err := d.readString()
+        b, err := d.readByte()
         if err != nil {
             return nil, err
         }
-        value, err := d.readValue()
-        if err != nil {
+        if b == 'e' {
+            break
+        } else if err := d.unreadByte(); err != nil {
             return nil, err
         }
-        dict[key] = value
 
-        b, err := d.readByte()
+        key, err := d.readString()
         if err != nil {
             return nil, err
         }
-
-        if b == 'e' {
-            break
-        } else if err := d.unreadByte(); err != nil {
+        value, err := d.readValue()
+        if err != nil {
             return nil, err
         }
+        dict[key] = value
     }
     return dict, nil
 }
@@ -144,24 +151,23 @@ func (d *decoder) readInt() (any, error) {
 }
 
 func (d *decoder) readList() ([]any, error) {
-    var l []any
+    l := []any{}
     for {
-        v, err := d.readValue()
-        if err != nil {
-            return nil, err
-        }
-        l = append(l, v)
-
         b, err := d.readByte()
         if err != nil {
             return nil, err
         }
-
         if b == 'e' {
             break
         } else if err := d.unreadByte(); err != nil {
             return nil, err
         }
+
+        v, err := d.readValue()
+        if err != nil {
+            return nil, err
+        }
+        l = append(l, v)
     }
     return l, nil
 }
@@ -5,11 +5,17 @@ type Bitfield []byte
 func (bf Bitfield) HasPiece(idx int) bool {
     byteIdx := idx/8
     offset := idx%8
+    if idx < 0 || byteIdx >= len(bf) {
+        return false
+    }
     return (bf[byteIdx] >> (7 - offset) & 1) != 0
 }
 
 func (bf Bitfield) SetPiece(idx int) {
     byteIdx := idx/8
     offset := idx%8
+    if idx < 0 || byteIdx >= len(bf) {
+        return
+    }
     bf[byteIdx] |= 1 << (7 - offset)
 }
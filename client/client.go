@@ -2,8 +2,10 @@ package client
 
 import (
     "bytes"
+    "context"
     "fmt"
     "net"
+    "sync"
     "time"
 
     "github.com/lauchimoon/torreja/handshake"
@@ -14,36 +16,90 @@ import (
 
 type Client struct {
     Conn     net.Conn
+    // the peer is choking us (peer_choking)
     Choked   bool
+    // we are choking the peer (am_choking)
+    Choking  bool
+    // we want pieces the peer has (am_interested)
+    Interested bool
+    // the peer wants pieces we have (peer_interested)
+    PeerInterested bool
+    // nil until the peer sends a bitfield, HaveAll or HaveNone
     Bitfield bf.Bitfield
+    // pieces the peer lets us download while it is choking us
+    AllowedFast map[int]bool
     peer     peers.Peer
     infoHash [20]byte
     peerId   string
+    // reserved bits the peer sent in its handshake
+    reserved [8]byte
+    writeMu  sync.Mutex
 }
 
-func New(peer peers.Peer, peerId string, infoHash [20]byte) (*Client, error) {
-    conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+// New connects to a peer, giving up as soon as ctx is done. wrap, if not
+// nil, is given the connection before anything is sent on it.
+func New(ctx context.Context, peer peers.Peer, peerId string, infoHash [20]byte, wrap func(net.Conn) net.Conn) (*Client, error) {
+    dialer := net.Dialer{Timeout: 3*time.Second}
+    conn, err := dialer.DialContext(ctx, "tcp", peer.String())
     if err != nil {
         return nil, err
     }
+    if wrap != nil {
+        conn = wrap(conn)
+    }
 
-    _, err = completeHandshake(conn, infoHash, peerId)
+    stop := context.AfterFunc(ctx, func() {
+        conn.Close()
+    })
+    res, err := completeHandshake(conn, infoHash, peerId)
+    if !stop() {
+        return nil, ctx.Err()
+    }
     if err != nil {
+        conn.Close()
         return nil, err
     }
 
-    bitField, err := receiveBitfield(conn)
+    return &Client{
+        Conn: conn,
+        Choked: true,
+        Choking: true,
+        AllowedFast: make(map[int]bool),
+        peer: peer,
+        infoHash: infoHash,
+        peerId: peerId,
+        reserved: res.Reserved,
+    }, nil
+}
+
+// Accept finishes the handshake of an inbound connection whose handshake
+// has already been read, and answers with ours.
+func Accept(conn net.Conn, hs *handshake.Handshake, peerId string) (*Client, error) {
+    conn.SetDeadline(time.Now().Add(5*time.Second))
+    defer conn.SetDeadline(time.Time{})
+
+    res := handshake.New(hs.InfoHash, peerId)
+    res.Set(handshake.Extended)
+    res.Set(handshake.Fast)
+    _, err := conn.Write(res.Serialize())
     if err != nil {
         return nil, err
     }
 
+    peer := peers.Peer{}
+    if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+        peer.Ip = addr.IP
+        peer.Port = int64(addr.Port)
+    }
     return &Client{
         Conn: conn,
         Choked: true,
-        Bitfield: bitField,
+        Choking: true,
+        AllowedFast: make(map[int]bool),
         peer: peer,
-        infoHash: infoHash,
+        infoHash: hs.InfoHash,
         peerId: peerId,
+        reserved: hs.Reserved,
     }, nil
 }
 
@@ -52,6 +108,8 @@ func completeHandshake(conn net.Conn, infoHash [20]byte, peerId string) (*handsh
     defer conn.SetDeadline(time.Time{})
 
     hs := handshake.New(infoHash, peerId)
+    hs.Set(handshake.Extended)
+    hs.Set(handshake.Fast)
     _, err := conn.Write(hs.Serialize())
     if err != nil {
         return nil, err
@@ -67,44 +125,96 @@ func completeHandshake(conn net.Conn, infoHash [20]byte, peerId string) (*handsh
     return res, nil
 }
 
-func receiveBitfield(conn net.Conn) (bf.Bitfield, error) {
-    conn.SetDeadline(time.Now().Add(5*time.Second))
-    defer conn.SetDeadline(time.Time{})
+func (c *Client) Read() (*message.Message, error) {
+    return message.Read(c.Conn)
+}
 
-    msg, err := message.Read(conn)
-    if err != nil {
-        return nil, err
-    }
-    if msg.Id != message.IdBitfield {
-        return nil, fmt.Errorf("expected bitfield message, got id %d", msg.Id)
-    }
-    return msg.Payload, nil
+func (c *Client) Peer() peers.Peer {
+    return c.peer
 }
 
-func (c *Client) Read() (*message.Message, error) {
-    return message.Read(c.Conn)
+// Supports tells whether the peer advertised an extension in its handshake.
+func (c *Client) Supports(bit handshake.ReservedBit) bool {
+    hs := handshake.Handshake{Reserved: c.reserved}
+    return hs.Has(bit)
 }
 
-func (c *Client) SendUnchoked() error {
-    msg := message.Message{Id: message.IdUnchoke}
+// Fast tells whether both sides use the Fast Extension, we always do.
+func (c *Client) Fast() bool {
+    return c.Supports(handshake.Fast)
+}
+
+// SetHaveAll records the Fast Extension replacement for a bitfield of a
+// torrent with numPieces pieces in which the peer has every piece.
+func (c *Client) SetHaveAll(numPieces int) {
+    c.Bitfield = make(bf.Bitfield, (numPieces+7)/8)
+    for i := 0; i < numPieces; i++ {
+        c.Bitfield.SetPiece(i)
+    }
+}
+
+// Send writes a message to the peer. It is safe to call from several
+// goroutines.
+func (c *Client) Send(msg *message.Message) error {
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
     _, err := c.Conn.Write(msg.Serialize())
     return err
 }
 
+func (c *Client) SendUnchoked() error {
+    return c.Send(&message.Message{Id: message.IdUnchoke})
+}
+
+func (c *Client) SendChoked() error {
+    return c.Send(&message.Message{Id: message.IdChoke})
+}
+
 func (c *Client) SendInterested() error {
-    msg := message.Message{Id: message.IdInterested}
-    _, err := c.Conn.Write(msg.Serialize())
-    return err
+    return c.Send(&message.Message{Id: message.IdInterested})
+}
+
+func (c *Client) SendNotInterested() error {
+    return c.Send(&message.Message{Id: message.IdNotInterested})
 }
 
 func (c *Client) SendHave(idx int) error {
-    msg := message.FormatHave(idx)
-    _, err := c.Conn.Write(msg.Serialize())
-    return err
+    return c.Send(message.FormatHave(idx))
 }
 
 func (c *Client) SendRequest(idx int, requestedBytes, blockSize int64) error {
-    msg := message.FormatRequest(idx, requestedBytes, blockSize)
-    _, err := c.Conn.Write(msg.Serialize())
-    return err
+    return c.Send(message.FormatRequest(idx, requestedBytes, blockSize))
+}
+
+func (c *Client) SendCancel(idx int, begin, length int64) error {
+    return c.Send(message.FormatCancel(idx, begin, length))
+}
+
+func (c *Client) SendHaveAll() error {
+    return c.Send(message.FormatHaveAll())
+}
+
+func (c *Client) SendHaveNone() error {
+    return c.Send(message.FormatHaveNone())
+}
+
+func (c *Client) SendReject(idx int, begin, length int64) error {
+    return c.Send(message.FormatReject(idx, begin, length))
+}
+
+func (c *Client) SendAllowedFast(idx int) error {
+    return c.Send(message.FormatAllowedFast(idx))
+}
+
+func (c *Client) SendBitfield(bitfield bf.Bitfield) error {
+    return c.Send(message.FormatBitfield(bitfield))
+}
+
+func (c *Client) SendPiece(idx int, begin int64, data []byte) error {
+    return c.Send(message.FormatPiece(idx, begin, data))
+}
+
+func (c *Client) SendKeepAlive() error {
+    var msg *message.Message
+    return c.Send(msg)
 }
@@ -0,0 +1,613 @@
+package dht
+
+import (
+    "crypto/rand"
+    "crypto/sha1"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/lauchimoon/torreja/bencode"
+    "github.com/lauchimoon/torreja/peers"
+)
+
+// Mainline DHT, BEP 5.
+
+var DefaultBootstrapNodes = []string{
+    "router.bittorrent.com:6881",
+    "dht.transmissionbt.com:6881",
+    "router.utorrent.com:6881",
+}
+
+// number of queries in flight during a lookup
+const alpha = 3
+const queryTimeout = 2*time.Second
+const tokenRotation = 5*time.Minute
+const refreshInterval = 15*time.Minute
+// announced peers are forgotten after this long
+const peerTTL = 30*time.Minute
+const maxValues = 50
+
+type Config struct {
+    // UDP address to listen on, e.g. ":6881"
+    Addr string
+    // "host:port" of nodes used to join the network
+    BootstrapNodes []string
+    // file the node id and routing table are kept in, none if empty
+    StatePath string
+}
+
+type Server struct {
+    config Config
+    id     [20]byte
+    conn   *net.UDPConn
+    table  *table
+
+    mu            sync.Mutex
+    pending       map[string]chan map[string]any
+    transactionId uint16
+    secret        [20]byte
+    prevSecret    [20]byte
+    rotated       time.Time
+    // peers announced to us, by info hash
+    stored map[[20]byte]map[string]storedPeer
+
+    closeOnce sync.Once
+    closed    chan struct{}
+}
+
+type storedPeer struct {
+    peer  peers.Peer
+    added time.Time
+}
+
+func New(config Config) (*Server, error) {
+    addr, err := net.ResolveUDPAddr("udp4", config.Addr)
+    if err != nil {
+        return nil, err
+    }
+    conn, err := net.ListenUDP("udp4", addr)
+    if err != nil {
+        return nil, err
+    }
+
+    s := &Server{
+        config: config,
+        conn: conn,
+        pending: make(map[string]chan map[string]any),
+        stored: make(map[[20]byte]map[string]storedPeer),
+        rotated: time.Now(),
+        closed: make(chan struct{}),
+    }
+    rand.Read(s.secret[:])
+    rand.Read(s.prevSecret[:])
+
+    saved, err := s.load()
+    if err != nil {
+        rand.Read(s.id[:])
+        s.table = newTable(s.id)
+    } else {
+        s.id = saved.id
+        s.table = newTable(s.id)
+        for _, n := range saved.nodes {
+            s.table.insert(n)
+        }
+    }
+
+    go s.serve()
+    go s.refresh()
+    return s, nil
+}
+
+func (s *Server) Id() [20]byte {
+    return s.id
+}
+
+func (s *Server) Addr() *net.UDPAddr {
+    return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// NumNodes returns the number of good nodes in the routing table.
+func (s *Server) NumNodes() int {
+    return len(s.table.nodes())
+}
+
+// Close saves the routing table and stops the server.
+func (s *Server) Close() error {
+    err := s.Save()
+    s.closeOnce.Do(func() {
+        close(s.closed)
+        s.conn.Close()
+    })
+    return err
+}
+
+// Bootstrap pings the configured bootstrap nodes and then looks up our
+// own id, filling the routing table with the nodes closest to us.
+func (s *Server) Bootstrap() error {
+    var wg sync.WaitGroup
+    for _, host := range s.config.BootstrapNodes {
+        addr, err := net.ResolveUDPAddr("udp4", host)
+        if err != nil {
+            continue
+        }
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            s.Ping(addr)
+        }()
+    }
+    wg.Wait()
+
+    if s.NumNodes() == 0 {
+        return errors.New("no dht node answered")
+    }
+    s.lookup(s.id, "find_node")
+    return s.Save()
+}
+
+// AddNode pings a node, adding it to the routing table if it answers.
+func (s *Server) AddNode(host string) error {
+    addr, err := net.ResolveUDPAddr("udp4", host)
+    if err != nil {
+        return err
+    }
+    return s.Ping(addr)
+}
+
+func (s *Server) Ping(addr *net.UDPAddr) error {
+    _, err := s.query(addr, "ping", map[string]any{})
+    return err
+}
+
+// GetPeers looks for peers of a torrent.
+func (s *Server) GetPeers(infoHash [20]byte) ([]peers.Peer, error) {
+    res, err := s.lookup(infoHash, "get_peers")
+    if err != nil {
+        return nil, err
+    }
+    return res.peers, nil
+}
+
+// Announce looks for peers of a torrent and tells the closest nodes that
+// we are downloading it on port.
+func (s *Server) Announce(infoHash [20]byte, port int64) ([]peers.Peer, error) {
+    res, err := s.lookup(infoHash, "get_peers")
+    if err != nil {
+        return nil, err
+    }
+
+    var wg sync.WaitGroup
+    for _, n := range res.closest {
+        token, ok := res.tokens[n.id]
+        if !ok {
+            continue
+        }
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            s.query(n.addr, "announce_peer", map[string]any{
+                "info_hash": string(infoHash[:]),
+                "port": port,
+                "token": token,
+            })
+        }()
+    }
+    wg.Wait()
+    return res.peers, nil
+}
+
+type lookupResult struct {
+    peers   []peers.Peer
+    // closest nodes that answered
+    closest []node
+    tokens  map[[20]byte]string
+}
+
+// lookup queries nodes closer and closer to target until the K closest
+// ones known have all been asked.
+func (s *Server) lookup(target [20]byte, method string) (*lookupResult, error) {
+    shortlist := s.table.closest(target, K)
+    if len(shortlist) == 0 {
+        return nil, errors.New("dht routing table is empty")
+    }
+
+    var mu sync.Mutex
+    seen := make(map[[20]byte]bool)
+    queried := make(map[[20]byte]bool)
+    responded := []node{}
+    found := make(map[string]peers.Peer)
+    res := &lookupResult{tokens: make(map[[20]byte]string)}
+    for _, n := range shortlist {
+        seen[n.id] = true
+    }
+
+    for {
+        batch := []node{}
+        mu.Lock()
+        sortByDistance(shortlist, target)
+        for i := 0; i < len(shortlist) && i < K && len(batch) < alpha; i++ {
+            if !queried[shortlist[i].id] {
+                queried[shortlist[i].id] = true
+                batch = append(batch, shortlist[i])
+            }
+        }
+        mu.Unlock()
+        if len(batch) == 0 {
+            break
+        }
+
+        var wg sync.WaitGroup
+        for _, n := range batch {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                key := "target"
+                if method == "get_peers" {
+                    key = "info_hash"
+                }
+                r, err := s.query(n.addr, method, map[string]any{key: string(target[:])})
+                if err != nil {
+                    return
+                }
+                nodes, _ := r["nodes"].(string)
+                list, _ := decodeNodes(nodes)
+                values, _ := r["values"].([]any)
+
+                mu.Lock()
+                defer mu.Unlock()
+                responded = append(responded, n)
+                if token, ok := r["token"].(string); ok {
+                    res.tokens[n.id] = token
+                }
+                for _, peer := range decodeValues(values) {
+                    found[peer.String()] = peer
+                }
+                for _, c := range list {
+                    if !seen[c.id] && c.id != s.id {
+                        seen[c.id] = true
+                        shortlist = append(shortlist, c)
+                    }
+                }
+            }()
+        }
+        wg.Wait()
+    }
+
+    sortByDistance(responded, target)
+    if len(responded) > K {
+        responded = responded[:K]
+    }
+    res.closest = responded
+    for _, peer := range found {
+        res.peers = append(res.peers, peer)
+    }
+    return res, nil
+}
+
+func (s *Server) refresh() {
+    ticker := time.NewTicker(refreshInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            s.lookup(s.id, "find_node")
+            s.expirePeers()
+        case <-s.closed:
+            return
+        }
+    }
+}
+
+func (s *Server) query(addr *net.UDPAddr, method string, args map[string]any) (map[string]any, error) {
+    args["id"] = string(s.id[:])
+    res := make(chan map[string]any, 1)
+
+    s.mu.Lock()
+    s.transactionId++
+    t := string(binary.BigEndian.AppendUint16(nil, s.transactionId))
+    key := t + addr.String()
+    s.pending[key] = res
+    s.mu.Unlock()
+    defer func() {
+        s.mu.Lock()
+        delete(s.pending, key)
+        s.mu.Unlock()
+    }()
+
+    packet := bencode.Encode(map[string]any{"t": t, "y": "q", "q": method, "a": args})
+    _, err := s.conn.WriteToUDP([]byte(packet), addr)
+    if err != nil {
+        return nil, err
+    }
+
+    timer := time.NewTimer(queryTimeout)
+    defer timer.Stop()
+    select {
+    case msg := <-res:
+        if msg["y"] == "e" {
+            return nil, parseError(msg)
+        }
+        r, ok := msg["r"].(map[string]any)
+        if !ok {
+            return nil, errors.New("response has no 'r' dictionary")
+        }
+        id, ok := getId(r)
+        if !ok {
+            return nil, errors.New("response has no valid node id")
+        }
+        s.heard(id, addr)
+        return r, nil
+    case <-timer.C:
+        s.table.failed(s.nodeAt(addr))
+        return nil, fmt.Errorf("dht node %s did not respond to %s", addr, method)
+    case <-s.closed:
+        return nil, errors.New("dht server closed")
+    }
+}
+
+func parseError(msg map[string]any) error {
+    list, ok := msg["e"].([]any)
+    if !ok || len(list) < 2 {
+        return errors.New("dht node sent an invalid error")
+    }
+    code, _ := list[0].(int64)
+    message, _ := list[1].(string)
+    return &krpcError{code, message}
+}
+
+// nodeAt finds the id of the routing table node at addr.
+func (s *Server) nodeAt(addr *net.UDPAddr) [20]byte {
+    for _, n := range s.table.nodes() {
+        if n.addr.IP.Equal(addr.IP) && n.addr.Port == addr.Port {
+            return n.id
+        }
+    }
+    return s.id
+}
+
+// heard adds a node to the routing table. If its bucket is full of nodes
+// that have gone quiet, the oldest one is pinged and replaced if it does
+// not answer.
+func (s *Server) heard(id [20]byte, addr *net.UDPAddr) {
+    n := node{id: id, addr: addr, lastSeen: time.Now()}
+    stale := s.table.insert(n)
+    if stale == nil {
+        return
+    }
+    go func() {
+        if s.Ping(stale.addr) != nil {
+            s.table.replace(stale.id, n)
+        }
+    }()
+}
+
+func (s *Server) serve() {
+    buf := make([]byte, 65536)
+    for {
+        size, addr, err := s.conn.ReadFromUDP(buf)
+        if err != nil {
+            select {
+            case <-s.closed:
+                return
+            default:
+                continue
+            }
+        }
+        msg, err := bencode.Decode(string(buf[:size]))
+        if err != nil {
+            continue
+        }
+        t, ok := msg["t"].(string)
+        if !ok {
+            continue
+        }
+
+        switch msg["y"] {
+        case "q":
+            s.handleQuery(t, addr, msg)
+        case "r", "e":
+            s.mu.Lock()
+            res, ok := s.pending[t + addr.String()]
+            s.mu.Unlock()
+            if ok {
+                select {
+                case res <- msg:
+                default:
+                }
+            }
+        }
+    }
+}
+
+func (s *Server) handleQuery(t string, addr *net.UDPAddr, msg map[string]any) {
+    method, _ := msg["q"].(string)
+    args, ok := msg["a"].(map[string]any)
+    if !ok {
+        s.sendError(t, addr, errProtocol, "query has no 'a' dictionary")
+        return
+    }
+    id, ok := getId(args)
+    if !ok {
+        s.sendError(t, addr, errProtocol, "query has no valid node id")
+        return
+    }
+
+    res := map[string]any{"id": string(s.id[:])}
+    switch method {
+    case "ping":
+    case "find_node":
+        target, ok := getHash(args, "target")
+        if !ok {
+            s.sendError(t, addr, errProtocol, "find_node has no valid target")
+            return
+        }
+        res["nodes"] = encodeNodes(s.table.closest(target, K))
+    case "get_peers":
+        infoHash, ok := getHash(args, "info_hash")
+        if !ok {
+            s.sendError(t, addr, errProtocol, "get_peers has no valid info_hash")
+            return
+        }
+        res["token"] = s.token(addr.IP, false)
+        values := encodeValues(s.peersFor(infoHash))
+        if len(values) > 0 {
+            res["values"] = values
+        } else {
+            res["nodes"] = encodeNodes(s.table.closest(infoHash, K))
+        }
+    case "announce_peer":
+        infoHash, ok := getHash(args, "info_hash")
+        if !ok {
+            s.sendError(t, addr, errProtocol, "announce_peer has no valid info_hash")
+            return
+        }
+        token, _ := args["token"].(string)
+        if !s.validToken(addr.IP, token) {
+            s.sendError(t, addr, errProtocol, "bad token")
+            return
+        }
+        port, _ := args["port"].(int64)
+        if implied, _ := args["implied_port"].(int64); implied != 0 {
+            port = int64(addr.Port)
+        }
+        if port <= 0 || port > 65535 {
+            s.sendError(t, addr, errProtocol, "invalid port")
+            return
+        }
+        s.storePeer(infoHash, peers.Peer{Ip: addr.IP, Port: port})
+    default:
+        s.sendError(t, addr, errMethodUnknown, "method unknown")
+        return
+    }
+
+    s.heard(id, addr)
+    s.send(addr, map[string]any{"t": t, "y": "r", "r": res})
+}
+
+func (s *Server) sendError(t string, addr *net.UDPAddr, code int64, message string) {
+    s.send(addr, map[string]any{"t": t, "y": "e", "e": []any{code, message}})
+}
+
+func (s *Server) send(addr *net.UDPAddr, msg map[string]any) {
+    s.conn.WriteToUDP([]byte(bencode.Encode(msg)), addr)
+}
+
+// Tokens are a hash of the querying node's ip and a secret that changes
+// every five minutes. Tokens made with the previous secret are still
+// accepted.
+func (s *Server) token(ip net.IP, previous bool) string {
+    s.mu.Lock()
+    if time.Since(s.rotated) > tokenRotation {
+        s.prevSecret = s.secret
+        rand.Read(s.secret[:])
+        s.rotated = time.Now()
+    }
+    secret := s.secret
+    if previous {
+        secret = s.prevSecret
+    }
+    s.mu.Unlock()
+
+    h := sha1.New()
+    h.Write(ip.To16())
+    h.Write(secret[:])
+    return string(h.Sum(nil)[:8])
+}
+
+func (s *Server) validToken(ip net.IP, token string) bool {
+    return token != "" && (token == s.token(ip, false) || token == s.token(ip, true))
+}
+
+func (s *Server) storePeer(infoHash [20]byte, peer peers.Peer) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.stored[infoHash] == nil {
+        s.stored[infoHash] = make(map[string]storedPeer)
+    }
+    s.stored[infoHash][peer.String()] = storedPeer{peer, time.Now()}
+}
+
+func (s *Server) peersFor(infoHash [20]byte) []peers.Peer {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    list := []peers.Peer{}
+    for _, stored := range s.stored[infoHash] {
+        if time.Since(stored.added) > peerTTL {
+            continue
+        }
+        list = append(list, stored.peer)
+        if len(list) == maxValues {
+            break
+        }
+    }
+    return list
+}
+
+func (s *Server) expirePeers() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for infoHash, list := range s.stored {
+        for key, stored := range list {
+            if time.Since(stored.added) > peerTTL {
+                delete(list, key)
+            }
+        }
+        if len(list) == 0 {
+            delete(s.stored, infoHash)
+        }
+    }
+}
+
+type state struct {
+    id    [20]byte
+    nodes []node
+}
+
+// Save writes the node id and routing table to the state file.
+func (s *Server) Save() error {
+    if s.config.StatePath == "" {
+        return nil
+    }
+    data := bencode.Encode(map[string]any{
+        "id": string(s.id[:]),
+        "nodes": encodeNodes(s.table.nodes()),
+    })
+    tmp := s.config.StatePath + ".tmp"
+    err := os.WriteFile(tmp, []byte(data), 0644)
+    if err != nil {
+        return err
+    }
+    return os.Rename(tmp, s.config.StatePath)
+}
+
+func (s *Server) load() (*state, error) {
+    if s.config.StatePath == "" {
+        return nil, errors.New("no state file")
+    }
+    data, err := os.ReadFile(s.config.StatePath)
+    if err != nil {
+        return nil, err
+    }
+    decoded, err := bencode.Decode(string(data))
+    if err != nil {
+        return nil, err
+    }
+    id, ok := getId(decoded)
+    if !ok {
+        return nil, errors.New("dht state has no valid node id")
+    }
+    nodes, _ := decoded["nodes"].(string)
+    list, err := decodeNodes(nodes)
+    if err != nil {
+        return nil, err
+    }
+    for i := range list {
+        list[i].lastSeen = time.Now()
+    }
+    return &state{id, list}, nil
+}
@@ -0,0 +1,128 @@
+package dht
+
+import (
+    "net"
+    "path/filepath"
+    "testing"
+
+    "github.com/lauchimoon/torreja/peers"
+)
+
+func TestNodesRoundTrip(t *testing.T) {
+    nodes := []node{
+        {id: [20]byte{1, 2, 3}, addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}},
+        {id: [20]byte{0xff}, addr: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 51413}},
+        // not representable in compact node info, dropped
+        {id: [20]byte{4}, addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}},
+    }
+    encoded := encodeNodes(nodes)
+    if len(encoded) != 2*compactNodeLen {
+        t.Fatalf("encoded %d bytes, want %d", len(encoded), 2*compactNodeLen)
+    }
+
+    decoded, err := decodeNodes(encoded)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(decoded) != 2 {
+        t.Fatalf("decoded %d nodes, want 2", len(decoded))
+    }
+    for i, n := range decoded {
+        if n.id != nodes[i].id || !n.addr.IP.Equal(nodes[i].addr.IP) || n.addr.Port != nodes[i].addr.Port {
+            t.Errorf("node %d: got %x %s, want %x %s", i, n.id, n.addr, nodes[i].id, nodes[i].addr)
+        }
+    }
+}
+
+func TestDecodeNodesInvalidLength(t *testing.T) {
+    _, err := decodeNodes(string(make([]byte, compactNodeLen+1)))
+    if err == nil {
+        t.Fatal("expected an error for truncated node info")
+    }
+}
+
+func TestValuesRoundTrip(t *testing.T) {
+    list := []peers.Peer{
+        {Ip: net.IPv4(10, 0, 0, 1), Port: 6881},
+        {Ip: net.IPv4(127, 0, 0, 1), Port: 1},
+    }
+    decoded := decodeValues(encodeValues(list))
+    if len(decoded) != len(list) {
+        t.Fatalf("decoded %d peers, want %d", len(decoded), len(list))
+    }
+    for i, peer := range decoded {
+        if peer.String() != list[i].String() {
+            t.Errorf("peer %d: got %s, want %s", i, peer, list[i])
+        }
+    }
+}
+
+func TestStateRoundTrip(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "dht.dat")
+    s, err := New(Config{Addr: "127.0.0.1:0", StatePath: path})
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.table.insert(node{id: [20]byte{9}, addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 6881}})
+    err = s.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    s2, err := New(Config{Addr: "127.0.0.1:0", StatePath: path})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s2.Close()
+    if s2.Id() != s.Id() {
+        t.Errorf("got id %x after reload, want %x", s2.Id(), s.Id())
+    }
+    if s2.NumNodes() != 1 {
+        t.Errorf("got %d nodes after reload, want 1", s2.NumNodes())
+    }
+}
+
+// TestNetwork runs a small DHT on the loopback interface: every node joins
+// through the first one, one announces a torrent and another finds it.
+func TestNetwork(t *testing.T) {
+    const numNodes = 8
+    servers := []*Server{}
+    for i := 0; i < numNodes; i++ {
+        config := Config{Addr: "127.0.0.1:0"}
+        if i > 0 {
+            config.BootstrapNodes = []string{servers[0].Addr().String()}
+        }
+        s, err := New(config)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer s.Close()
+        servers = append(servers, s)
+    }
+    for _, s := range servers[1:] {
+        err := s.Bootstrap()
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    if servers[0].NumNodes() != numNodes-1 {
+        t.Errorf("first node knows %d nodes, want %d", servers[0].NumNodes(), numNodes-1)
+    }
+
+    infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef}
+    found, err := servers[1].Announce(infoHash, 5555)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(found) != 0 {
+        t.Errorf("got %d peers before anyone announced, want 0", len(found))
+    }
+
+    found, err = servers[numNodes-1].GetPeers(infoHash)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(found) != 1 || found[0].String() != "127.0.0.1:5555" {
+        t.Fatalf("got peers %v, want [127.0.0.1:5555]", found)
+    }
+}
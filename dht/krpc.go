@@ -0,0 +1,116 @@
+package dht
+
+import (
+    "encoding/binary"
+    "errors"
+    "net"
+
+    "github.com/lauchimoon/torreja/peers"
+)
+
+// KRPC error codes
+const (
+    errGeneric = 201
+    errServer = 202
+    errProtocol = 203
+    errMethodUnknown = 204
+)
+
+const compactNodeLen = 26
+
+type krpcError struct {
+    code    int64
+    message string
+}
+
+func (e *krpcError) Error() string {
+    return e.message
+}
+
+func compactAddr(addr *net.UDPAddr) string {
+    buf := make([]byte, 6)
+    copy(buf, addr.IP.To4())
+    binary.BigEndian.PutUint16(buf[4:], uint16(addr.Port))
+    return string(buf)
+}
+
+func parseCompactAddr(s string) *net.UDPAddr {
+    ip := make(net.IP, 4)
+    copy(ip, s[0:4])
+    return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16([]byte(s[4:6])))}
+}
+
+// encodeNodes writes the compact node info of every IPv4 node.
+func encodeNodes(nodes []node) string {
+    buf := []byte{}
+    for _, n := range nodes {
+        if n.addr.IP.To4() == nil {
+            continue
+        }
+        buf = append(buf, n.id[:]...)
+        buf = append(buf, compactAddr(n.addr)...)
+    }
+    return string(buf)
+}
+
+func decodeNodes(s string) ([]node, error) {
+    if len(s) % compactNodeLen != 0 {
+        return nil, errors.New("compact node info has invalid length")
+    }
+    list := []node{}
+    for i := 0; i < len(s); i += compactNodeLen {
+        n := node{addr: parseCompactAddr(s[i+20:i+compactNodeLen])}
+        copy(n.id[:], s[i:i+20])
+        if n.addr.Port == 0 {
+            continue
+        }
+        list = append(list, n)
+    }
+    return list, nil
+}
+
+func encodeValues(list []peers.Peer) []any {
+    values := []any{}
+    for _, peer := range list {
+        if peer.Ip.To4() == nil {
+            continue
+        }
+        values = append(values, compactAddr(&net.UDPAddr{IP: peer.Ip, Port: int(peer.Port)}))
+    }
+    return values
+}
+
+func decodeValues(raw []any) []peers.Peer {
+    list := []peers.Peer{}
+    for _, v := range raw {
+        s, ok := v.(string)
+        if !ok || len(s) != 6 {
+            continue
+        }
+        found, err := peers.Unmarshal([]byte(s))
+        if err == nil {
+            list = append(list, found...)
+        }
+    }
+    return list
+}
+
+func getId(dict map[string]any) ([20]byte, bool) {
+    var id [20]byte
+    s, ok := dict["id"].(string)
+    if !ok || len(s) != 20 {
+        return id, false
+    }
+    copy(id[:], s)
+    return id, true
+}
+
+func getHash(dict map[string]any, key string) ([20]byte, bool) {
+    var hash [20]byte
+    s, ok := dict[key].(string)
+    if !ok || len(s) != 20 {
+        return hash, false
+    }
+    copy(hash[:], s)
+    return hash, true
+}
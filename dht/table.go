@@ -0,0 +1,155 @@
+package dht
+
+import (
+    "bytes"
+    "math/bits"
+    "net"
+    "sort"
+    "sync"
+    "time"
+)
+
+// K is the size of a bucket and the number of nodes a lookup converges on.
+const K = 8
+
+// Nodes that have not been heard from in this long are questionable and
+// may be replaced by new ones after failing a ping.
+const questionableAfter = 15*time.Minute
+const maxFailures = 2
+
+type node struct {
+    id       [20]byte
+    addr     *net.UDPAddr
+    lastSeen time.Time
+    failures int
+}
+
+// table is the routing table. Bucket i holds the nodes whose distance to
+// us has i leading zero bits.
+type table struct {
+    self    [20]byte
+    mu      sync.Mutex
+    buckets [160][]*node
+}
+
+func newTable(self [20]byte) *table {
+    return &table{self: self}
+}
+
+func distance(a, b [20]byte) [20]byte {
+    var d [20]byte
+    for i := range d {
+        d[i] = a[i] ^ b[i]
+    }
+    return d
+}
+
+func (t *table) bucketIndex(id [20]byte) int {
+    d := distance(t.self, id)
+    for i, b := range d {
+        if b != 0 {
+            return i*8 + bits.LeadingZeros8(b)
+        }
+    }
+    return -1
+}
+
+// insert records that we heard from a node. When its bucket is full and
+// the oldest node there has gone quiet, that node is returned so the
+// caller can ping it and replace it if it does not answer.
+func (t *table) insert(n node) *node {
+    idx := t.bucketIndex(n.id)
+    if idx < 0 {
+        return nil
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    bucket := t.buckets[idx]
+    for i, existing := range bucket {
+        if existing.id == n.id {
+            existing.addr = n.addr
+            existing.lastSeen = n.lastSeen
+            existing.failures = 0
+            t.buckets[idx] = append(append(bucket[:i:i], bucket[i+1:]...), existing)
+            return nil
+        }
+    }
+    if len(bucket) < K {
+        t.buckets[idx] = append(bucket, &n)
+        return nil
+    }
+    for i, existing := range bucket {
+        if existing.failures >= maxFailures {
+            bucket[i] = &n
+            return nil
+        }
+    }
+    if time.Since(bucket[0].lastSeen) > questionableAfter {
+        stale := *bucket[0]
+        return &stale
+    }
+    return nil
+}
+
+// replace swaps a node that failed to answer for a new one.
+func (t *table) replace(old [20]byte, n node) {
+    idx := t.bucketIndex(old)
+    if idx < 0 {
+        return
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for i, existing := range t.buckets[idx] {
+        if existing.id == old {
+            t.buckets[idx][i] = &n
+            return
+        }
+    }
+}
+
+func (t *table) failed(id [20]byte) {
+    idx := t.bucketIndex(id)
+    if idx < 0 {
+        return
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for _, existing := range t.buckets[idx] {
+        if existing.id == id {
+            existing.failures++
+            return
+        }
+    }
+}
+
+func (t *table) nodes() []node {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    list := []node{}
+    for _, bucket := range t.buckets {
+        for _, n := range bucket {
+            if n.failures < maxFailures {
+                list = append(list, *n)
+            }
+        }
+    }
+    return list
+}
+
+func (t *table) closest(target [20]byte, k int) []node {
+    list := t.nodes()
+    sortByDistance(list, target)
+    if len(list) > k {
+        list = list[:k]
+    }
+    return list
+}
+
+func sortByDistance(list []node, target [20]byte) {
+    sort.Slice(list, func(i, j int) bool {
+        di := distance(list[i].id, target)
+        dj := distance(list[j].id, target)
+        return bytes.Compare(di[:], dj[:]) < 0
+    })
+}
@@ -0,0 +1,172 @@
+package extension
+
+import (
+    "errors"
+    "fmt"
+    "net"
+
+    "github.com/lauchimoon/torreja/bencode"
+    "github.com/lauchimoon/torreja/message"
+)
+
+// Extension protocol, BEP 10. Every extended message has id 20, and the
+// first byte of its payload is the id of the extension it belongs to.
+// Id 0 is the extended handshake, in which each side tells the other
+// which ids it wants to receive every extension with.
+
+const HandshakeId = 0
+
+type Handshake struct {
+    // extension names to the ids the sender wants them sent with, an id
+    // of 0 means the extension is disabled
+    M            map[string]int64
+    // client name and version
+    V            string
+    // port the sender accepts connections on
+    P            int64
+    // number of outstanding requests the sender allows
+    Reqq         int64
+    MetadataSize int64
+    // our address as seen by the sender
+    YourIp       net.IP
+}
+
+func (h *Handshake) Serialize() string {
+    m := map[string]any{}
+    for name, id := range h.M {
+        m[name] = id
+    }
+    dict := map[string]any{"m": m}
+    if h.V != "" {
+        dict["v"] = h.V
+    }
+    if h.P > 0 {
+        dict["p"] = h.P
+    }
+    if h.Reqq > 0 {
+        dict["reqq"] = h.Reqq
+    }
+    if h.MetadataSize > 0 {
+        dict["metadata_size"] = h.MetadataSize
+    }
+    if ip := h.YourIp.To4(); ip != nil {
+        dict["yourip"] = string(ip)
+    } else if ip := h.YourIp.To16(); ip != nil {
+        dict["yourip"] = string(ip)
+    }
+    return bencode.Encode(dict)
+}
+
+func ParseHandshake(payload []byte) (*Handshake, error) {
+    dict, err := bencode.Decode(string(payload))
+    if err != nil {
+        return nil, err
+    }
+    m, ok := dict["m"].(map[string]any)
+    if !ok {
+        return nil, errors.New("extended handshake has no 'm' dictionary")
+    }
+
+    h := &Handshake{M: make(map[string]int64)}
+    for name, raw := range m {
+        id, ok := raw.(int64)
+        if !ok || id < 0 || id > 255 {
+            return nil, fmt.Errorf("extended handshake has invalid id for %q", name)
+        }
+        h.M[name] = id
+    }
+    getField(dict, "v", &h.V)
+    getField(dict, "p", &h.P)
+    if h.P < 0 || h.P > 65535 {
+        h.P = 0
+    }
+    getField(dict, "reqq", &h.Reqq)
+    getField(dict, "metadata_size", &h.MetadataSize)
+    var yourIp string
+    getField(dict, "yourip", &yourIp)
+    if len(yourIp) == net.IPv4len || len(yourIp) == net.IPv6len {
+        h.YourIp = net.IP(yourIp)
+    }
+    return h, nil
+}
+
+// Id returns the id the sender wants name sent with, if it supports it.
+func (h *Handshake) Id(name string) (byte, bool) {
+    id := h.M[name]
+    return byte(id), id != 0
+}
+
+func Format(id byte, payload string) *message.Message {
+    return &message.Message{
+        Id: message.IdExtended,
+        Payload: append([]byte{id}, payload...),
+    }
+}
+
+// Parse splits an extended message into the extension id and its payload.
+func Parse(msg *message.Message) (byte, []byte, error) {
+    if msg.Id != message.IdExtended {
+        return 0, nil, fmt.Errorf("expected extended message, got id %d", msg.Id)
+    }
+    if len(msg.Payload) < 1 {
+        return 0, nil, errors.New("extended message has no id")
+    }
+    return msg.Payload[0], msg.Payload[1:], nil
+}
+
+// Registry gives the extensions we support the ids peers should send them
+// with, so that new extensions plug in by name.
+type Registry struct {
+    ids   map[string]byte
+    names map[byte]string
+}
+
+func NewRegistry(names ...string) *Registry {
+    r := &Registry{
+        ids: make(map[string]byte),
+        names: make(map[byte]string),
+    }
+    for _, name := range names {
+        r.Register(name)
+    }
+    return r
+}
+
+// Register adds an extension and returns its id.
+func (r *Registry) Register(name string) byte {
+    if id, ok := r.ids[name]; ok {
+        return id
+    }
+    id := byte(len(r.ids) + 1)
+    r.ids[name] = id
+    r.names[id] = name
+    return id
+}
+
+func (r *Registry) Id(name string) (byte, bool) {
+    id, ok := r.ids[name]
+    return id, ok
+}
+
+func (r *Registry) Name(id byte) (string, bool) {
+    name, ok := r.names[id]
+    return name, ok
+}
+
+// Handshake returns an extended handshake advertising every registered
+// extension.
+func (r *Registry) Handshake() *Handshake {
+    h := &Handshake{M: make(map[string]int64)}
+    for name, id := range r.ids {
+        h.M[name] = int64(id)
+    }
+    return h
+}
+
+func getField[T any](dict map[string]any, field string, target *T) {
+    if v, ok := dict[field]; ok {
+        if typedVal, ok := v.(T); ok {
+            *target = typedVal
+        }
+    }
+}
@@ -5,8 +5,21 @@ import (
     "io"
 )
 
+// ReservedBit is a bit of the reserved bytes used to advertise support for
+// a protocol extension.
+type ReservedBit struct {
+    Byte int
+    Mask byte
+}
+
+// extension protocol, BEP 10
+var Extended = ReservedBit{5, 0x10}
+// Fast Extension, BEP 6
+var Fast = ReservedBit{7, 0x04}
+
 type Handshake struct {
     Pstr     string
+    Reserved [8]byte
     InfoHash [20]byte
     PeerId   string
 }
@@ -19,6 +32,14 @@ func New(infoHash [20]byte, peerId string) *Handshake {
     }
 }
 
+func (hs *Handshake) Set(bit ReservedBit) {
+    hs.Reserved[bit.Byte] |= bit.Mask
+}
+
+func (hs *Handshake) Has(bit ReservedBit) bool {
+    return hs.Reserved[bit.Byte] & bit.Mask != 0
+}
+
 func (hs *Handshake) Serialize() []byte {
     const pstrByte = 1
     const numExtensions = 8
@@ -31,7 +52,7 @@ func (hs *Handshake) Serialize() []byte {
     buf[0] = byte(pstrLen)
     curr := 1
     curr += copy(buf[curr:], hs.Pstr)
-    curr += copy(buf[curr:], make([]byte, 8))
+    curr += copy(buf[curr:], hs.Reserved[:])
     curr += copy(buf[curr:], hs.InfoHash[:])
     curr += copy(buf[curr:], hs.PeerId)
 
@@ -59,11 +80,14 @@ func Read(r io.Reader) (*Handshake, error) {
     }
 
     var infoHash, peerId [20]byte
+    var reserved [8]byte
 
+    copy(reserved[:], handshakeBuf[pStrLen:pStrLen+8])
     copy(infoHash[:], handshakeBuf[pStrLen+8:pStrLen+8+20])
     copy(peerId[:], handshakeBuf[pStrLen+8+20:])
     return &Handshake{
         Pstr: string(handshakeBuf[0:pStrLen]),
+        Reserved: reserved,
         InfoHash: infoHash,
         PeerId: string(peerId[:]),
     }, nil
@@ -0,0 +1,273 @@
+package lsd
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/lauchimoon/torreja/peers"
+)
+
+// Local Service Discovery, BEP 14.
+
+var (
+    Group4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+    Group6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+// Every torrent is announced this often, and never more than once a
+// minute.
+const AnnounceInterval = 5*time.Minute
+const minInterval = time.Minute
+
+// info hashes sent in one message, keeping it well under the MTU
+const maxInfoHashes = 20
+
+type group struct {
+    addr     *net.UDPAddr
+    listener *net.UDPConn
+    sender   *net.UDPConn
+}
+
+type Service struct {
+    port   int64
+    // sent with our announces so that we can ignore them when they loop
+    // back to us
+    cookie string
+    groups []*group
+
+    mu        sync.Mutex
+    torrents  map[[20]byte]func([]peers.Peer)
+    announced map[[20]byte]time.Time
+
+    closeOnce sync.Once
+    closed    chan struct{}
+}
+
+// New joins the IPv4 and IPv6 multicast groups, announcing that we accept
+// connections on port. It only fails if neither group could be joined.
+func New(port int64) (*Service, error) {
+    cookie := make([]byte, 8)
+    rand.Read(cookie)
+    s := &Service{
+        port: port,
+        cookie: hex.EncodeToString(cookie),
+        torrents: make(map[[20]byte]func([]peers.Peer)),
+        announced: make(map[[20]byte]time.Time),
+        closed: make(chan struct{}),
+    }
+
+    var lastErr error
+    for _, addr := range []*net.UDPAddr{Group4, Group6} {
+        g, err := joinGroup(addr)
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        s.groups = append(s.groups, g)
+    }
+    if len(s.groups) == 0 {
+        return nil, lastErr
+    }
+
+    for _, g := range s.groups {
+        go s.listen(g)
+    }
+    go s.run()
+    return s, nil
+}
+
+func joinGroup(addr *net.UDPAddr) (*group, error) {
+    network := "udp4"
+    if addr.IP.To4() == nil {
+        network = "udp6"
+    }
+    listener, err := net.ListenMulticastUDP(network, nil, addr)
+    if err != nil {
+        return nil, err
+    }
+    // the listener has multicast loopback turned off, a separate socket
+    // lets other clients on this machine hear us
+    sender, err := net.ListenUDP(network, nil)
+    if err != nil {
+        listener.Close()
+        return nil, err
+    }
+    return &group{addr, listener, sender}, nil
+}
+
+func (s *Service) Close() error {
+    s.closeOnce.Do(func() {
+        close(s.closed)
+        for _, g := range s.groups {
+            g.listener.Close()
+            g.sender.Close()
+        }
+    })
+    return nil
+}
+
+// Add starts announcing a torrent, calling found with the peers that
+// announce it on the local network.
+func (s *Service) Add(infoHash [20]byte, found func([]peers.Peer)) {
+    s.mu.Lock()
+    s.torrents[infoHash] = found
+    s.mu.Unlock()
+    s.Announce(infoHash)
+}
+
+func (s *Service) Remove(infoHash [20]byte) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.torrents, infoHash)
+}
+
+// Announce sends the torrents to every group, skipping the ones announced
+// less than a minute ago.
+func (s *Service) Announce(infoHashes ...[20]byte) error {
+    s.mu.Lock()
+    due := [][20]byte{}
+    for _, infoHash := range infoHashes {
+        if time.Since(s.announced[infoHash]) < minInterval {
+            continue
+        }
+        s.announced[infoHash] = time.Now()
+        due = append(due, infoHash)
+    }
+    s.mu.Unlock()
+
+    var lastErr error
+    for len(due) > 0 {
+        n := min(len(due), maxInfoHashes)
+        for _, g := range s.groups {
+            _, err := g.sender.WriteToUDP(s.message(g.addr, due[:n]), g.addr)
+            if err != nil {
+                lastErr = err
+            }
+        }
+        due = due[n:]
+    }
+    return lastErr
+}
+
+func (s *Service) message(addr *net.UDPAddr, infoHashes [][20]byte) []byte {
+    var buf bytes.Buffer
+    buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+    fmt.Fprintf(&buf, "Host: %s\r\n", addr)
+    fmt.Fprintf(&buf, "Port: %d\r\n", s.port)
+    for _, infoHash := range infoHashes {
+        fmt.Fprintf(&buf, "Infohash: %x\r\n", infoHash)
+    }
+    fmt.Fprintf(&buf, "cookie: %s\r\n", s.cookie)
+    buf.WriteString("\r\n\r\n")
+    return buf.Bytes()
+}
+
+func (s *Service) run() {
+    ticker := time.NewTicker(AnnounceInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            s.mu.Lock()
+            infoHashes := [][20]byte{}
+            for infoHash := range s.torrents {
+                infoHashes = append(infoHashes, infoHash)
+            }
+            s.mu.Unlock()
+            s.Announce(infoHashes...)
+        case <-s.closed:
+            return
+        }
+    }
+}
+
+func (s *Service) listen(g *group) {
+    buf := make([]byte, 1500)
+    for {
+        size, addr, err := g.listener.ReadFromUDP(buf)
+        if err != nil {
+            select {
+            case <-s.closed:
+                return
+            default:
+                continue
+            }
+        }
+        ann, err := parse(buf[:size])
+        if err != nil || ann.cookie == s.cookie {
+            continue
+        }
+
+        peer := peers.Peer{Ip: addr.IP, Port: ann.port}
+        for _, infoHash := range ann.infoHashes {
+            s.mu.Lock()
+            found, ok := s.torrents[infoHash]
+            s.mu.Unlock()
+            if ok {
+                found([]peers.Peer{peer})
+            }
+        }
+    }
+}
+
+type announce struct {
+    port       int64
+    infoHashes [][20]byte
+    cookie     string
+}
+
+func parse(msg []byte) (*announce, error) {
+    r := bufio.NewReader(bytes.NewReader(msg))
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    if strings.TrimSpace(line) != "BT-SEARCH * HTTP/1.1" {
+        return nil, errors.New("not a BT-SEARCH message")
+    }
+
+    ann := &announce{}
+    for {
+        line, err := r.ReadString('\n')
+        line = strings.TrimSpace(line)
+        if line == "" {
+            break
+        }
+        key, value, ok := strings.Cut(line, ":")
+        if ok {
+            value = strings.TrimSpace(value)
+            switch http.CanonicalHeaderKey(strings.TrimSpace(key)) {
+            case "Port":
+                ann.port, err = strconv.ParseInt(value, 10, 64)
+                if err != nil || ann.port <= 0 || ann.port > 65535 {
+                    return nil, fmt.Errorf("invalid port %q", value)
+                }
+            case "Infohash":
+                raw, err := hex.DecodeString(value)
+                if err != nil || len(raw) != 20 {
+                    return nil, fmt.Errorf("invalid info hash %q", value)
+                }
+                ann.infoHashes = append(ann.infoHashes, [20]byte(raw))
+            case "Cookie":
+                ann.cookie = value
+            }
+        }
+        if err != nil {
+            break
+        }
+    }
+    if ann.port == 0 || len(ann.infoHashes) == 0 {
+        return nil, errors.New("BT-SEARCH message is missing port or info hash")
+    }
+    return ann, nil
+}
@@ -0,0 +1,92 @@
+package lsd
+
+import (
+    "testing"
+    "time"
+
+    "github.com/lauchimoon/torreja/peers"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+    s := &Service{port: 6881, cookie: "0123456789abcdef"}
+    infoHashes := [][20]byte{{1, 2, 3}, {0xff}}
+
+    ann, err := parse(s.message(Group4, infoHashes))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ann.port != 6881 {
+        t.Errorf("got port %d, want 6881", ann.port)
+    }
+    if ann.cookie != s.cookie {
+        t.Errorf("got cookie %q, want %q", ann.cookie, s.cookie)
+    }
+    if len(ann.infoHashes) != len(infoHashes) {
+        t.Fatalf("got %d info hashes, want %d", len(ann.infoHashes), len(infoHashes))
+    }
+    for i, infoHash := range ann.infoHashes {
+        if infoHash != infoHashes[i] {
+            t.Errorf("info hash %d: got %x, want %x", i, infoHash, infoHashes[i])
+        }
+    }
+}
+
+func TestParseInvalid(t *testing.T) {
+    const infoHash = "Infohash: 0102030405060708090a0b0c0d0e0f1011121314\r\n"
+    messages := map[string]string{
+        "wrong request line": "M-SEARCH * HTTP/1.1\r\nPort: 6881\r\n" + infoHash + "\r\n\r\n",
+        "no port": "BT-SEARCH * HTTP/1.1\r\n" + infoHash + "\r\n\r\n",
+        "bad port": "BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\n" + infoHash + "\r\n\r\n",
+        "no info hash": "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n\r\n",
+        "short info hash": "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: 0102\r\n\r\n\r\n",
+    }
+    for name, msg := range messages {
+        _, err := parse([]byte(msg))
+        if err == nil {
+            t.Errorf("%s: expected an error", name)
+        }
+    }
+}
+
+// TestLoopback announces a torrent from one service and expects another one
+// on the same machine to hear it over multicast.
+func TestLoopback(t *testing.T) {
+    sender, err := New(7001)
+    if err != nil {
+        t.Skip("cannot join multicast group:", err)
+    }
+    defer sender.Close()
+    receiver, err := New(7002)
+    if err != nil {
+        t.Skip("cannot join multicast group:", err)
+    }
+    defer receiver.Close()
+
+    infoHash := [20]byte{0xca, 0xfe}
+    heard := make(chan peers.Peer, 4)
+    receiver.Add(infoHash, func(list []peers.Peer) {
+        for _, peer := range list {
+            select {
+            case heard <- peer:
+            default:
+            }
+        }
+    })
+    // torrents we do not have are ignored
+    receiver.Add([20]byte{0xbe, 0xef}, func(list []peers.Peer) {
+        t.Errorf("heard %v for a torrent nobody announced", list)
+    })
+
+    err = sender.Announce(infoHash)
+    if err != nil {
+        t.Skip("cannot send to multicast group:", err)
+    }
+    select {
+    case peer := <-heard:
+        if peer.Port != 7001 {
+            t.Errorf("heard peer %s, want port 7001", peer)
+        }
+    case <-time.After(5*time.Second):
+        t.Fatal("announce was not heard")
+    }
+}
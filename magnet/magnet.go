@@ -0,0 +1,111 @@
+package magnet
+
+import (
+    "encoding/base32"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net"
+    "net/url"
+    "strconv"
+    "strings"
+
+    "github.com/lauchimoon/torreja/peers"
+)
+
+type Magnet struct {
+    InfoHash    [20]byte
+    DisplayName string
+    // exact length of the torrent (xl), 0 if unknown
+    Length      int64
+    Trackers    []string
+    Peers       []peers.Peer
+}
+
+func IsMagnet(s string) bool {
+    return strings.HasPrefix(s, "magnet:")
+}
+
+func Parse(uri string) (*Magnet, error) {
+    u, err := url.Parse(uri)
+    if err != nil {
+        return nil, err
+    }
+    if u.Scheme != "magnet" {
+        return nil, fmt.Errorf("expected magnet scheme, got %q", u.Scheme)
+    }
+    params, err := url.ParseQuery(u.RawQuery)
+    if err != nil {
+        return nil, err
+    }
+
+    m := Magnet{}
+    found := false
+    for _, xt := range params["xt"] {
+        if !strings.HasPrefix(xt, "urn:btih:") {
+            continue
+        }
+        m.InfoHash, err = parseInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+        if err != nil {
+            return nil, err
+        }
+        found = true
+        break
+    }
+    if !found {
+        return nil, errors.New("no 'xt=urn:btih' found in magnet link")
+    }
+
+    m.DisplayName = params.Get("dn")
+    if xl, err := strconv.ParseInt(params.Get("xl"), 10, 64); err == nil && xl > 0 {
+        m.Length = xl
+    }
+    m.Trackers = params["tr"]
+    for _, addr := range params["x.pe"] {
+        peer, err := parsePeer(addr)
+        if err != nil {
+            return nil, err
+        }
+        m.Peers = append(m.Peers, peer)
+    }
+    return &m, nil
+}
+
+func parseInfoHash(s string) ([20]byte, error) {
+    var hash [20]byte
+    var raw []byte
+    var err error
+    switch len(s) {
+    case 40:
+        raw, err = hex.DecodeString(s)
+    case 32:
+        raw, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+    default:
+        return hash, fmt.Errorf("info hash has invalid length %d", len(s))
+    }
+    if err != nil {
+        return hash, err
+    }
+    copy(hash[:], raw)
+    return hash, nil
+}
+
+func parsePeer(addr string) (peers.Peer, error) {
+    host, portStr, err := net.SplitHostPort(addr)
+    if err != nil {
+        return peers.Peer{}, err
+    }
+    port, err := strconv.ParseInt(portStr, 10, 64)
+    if err != nil || port <= 0 || port > 65535 {
+        return peers.Peer{}, fmt.Errorf("invalid peer port %q", portStr)
+    }
+    ip := net.ParseIP(host)
+    if ip == nil {
+        ips, err := net.LookupIP(host)
+        if err != nil || len(ips) == 0 {
+            return peers.Peer{}, fmt.Errorf("could not resolve peer %q", host)
+        }
+        ip = ips[0]
+    }
+    return peers.Peer{Ip: ip, Port: port}, nil
+}
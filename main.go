@@ -1,18 +1,251 @@
 package main
 
 import (
+    "context"
+    "encoding/hex"
+    "errors"
+    "flag"
+    "fmt"
+    "log"
     "os"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "github.com/lauchimoon/torreja/dht"
+    "github.com/lauchimoon/torreja/lsd"
+    "github.com/lauchimoon/torreja/magnet"
+    "github.com/lauchimoon/torreja/p2p"
+    "github.com/lauchimoon/torreja/ratelimit"
     "github.com/lauchimoon/torreja/torrent"
 )
 
+const (
+    exitOk = 0
+    exitBadData = 1
+    exitError = 2
+)
+
 func main() {
-    torr, err := torrent.New(os.Args[1])
+    if len(os.Args) < 2 {
+        usage()
+        os.Exit(exitError)
+    }
+
+    switch os.Args[1] {
+    case "verify":
+        os.Exit(verify(os.Args[2:]))
+    case "scrape":
+        os.Exit(scrape(os.Args[2:]))
+    default:
+        download(os.Args[1:])
+    }
+}
+
+func usage() {
+    fmt.Fprintln(os.Stderr, "usage: torreja [-seed] [-port n] [-dht=false] [-bootstrap nodes] [-lsd=false] [-upload-rate kib] [-download-rate kib] [-peer-upload-rate kib] [-peer-download-rate kib] <.torrent file or magnet link> <output path>")
+    fmt.Fprintln(os.Stderr, "       torreja verify <.torrent file> <output path>")
+    fmt.Fprintln(os.Stderr, "       torreja scrape <.torrent file>")
+    fmt.Fprintln(os.Stderr, "       torreja scrape <tracker url> <info hash>...")
+}
+
+func download(args []string) {
+    flags := flag.NewFlagSet("torreja", flag.ExitOnError)
+    flags.Usage = usage
+    seed := flags.Bool("seed", false, "keep uploading to peers after the download")
+    port := flags.Int("port", 6881, "port to accept peer connections on")
+    useDHT := flags.Bool("dht", true, "look for peers in the DHT")
+    bootstrap := flags.String("bootstrap", strings.Join(dht.DefaultBootstrapNodes, ","), "comma separated DHT nodes to join through")
+    useLSD := flags.Bool("lsd", true, "look for peers on the local network")
+    uploadRate := flags.Int64("upload-rate", 0, "most KiB/s to upload, 0 for no limit")
+    downloadRate := flags.Int64("download-rate", 0, "most KiB/s to download, 0 for no limit")
+    peerUploadRate := flags.Int64("peer-upload-rate", 0, "most KiB/s to upload to each peer, 0 for no limit")
+    peerDownloadRate := flags.Int64("peer-download-rate", 0, "most KiB/s to download from each peer, 0 for no limit")
+    flags.Parse(args)
+    args = flags.Args()
+    if len(args) < 2 {
+        usage()
+        os.Exit(exitError)
+    }
+
+    // the first signal stops the download cleanly, a second one kills us
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    context.AfterFunc(ctx, stop)
+
+    var d *dht.Server
+    if *useDHT {
+        d = startDHT(*port, strings.Split(*bootstrap, ","))
+        if d != nil {
+            defer d.Close()
+        }
+    }
+
+    var torr *torrent.Metainfo
+    var err error
+    if magnet.IsMagnet(args[0]) {
+        torr, err = torrent.NewFromMagnetWithDHT(ctx, args[0], d)
+    } else {
+        torr, err = torrent.New(args[0])
+    }
+    if errors.Is(err, context.Canceled) {
+        return
+    }
     if err != nil {
         panic(err)
     }
+    torr.DHT = d
+    torr.Limits = p2p.Limits{
+        GlobalUpload: ratelimit.New(*uploadRate*1024),
+        GlobalDownload: ratelimit.New(*downloadRate*1024),
+        PeerUpload: ratelimit.New(*peerUploadRate*1024),
+        PeerDownload: ratelimit.New(*peerDownloadRate*1024),
+    }
+
+    listener, err := p2p.Listen(fmt.Sprintf(":%d", *port))
+    if err != nil {
+        log.Printf("not accepting peer connections: %v", err)
+    } else {
+        defer listener.Close()
+        go listener.Serve()
+        torr.Listener = listener
 
-    err = torr.Download(os.Args[2])
+        // peers found on the local network can only reach us if we listen
+        if *useLSD {
+            service, err := lsd.New(int64(*port))
+            if err != nil {
+                log.Printf("not using local service discovery: %v", err)
+            } else {
+                defer service.Close()
+                torr.LSD = service
+            }
+        }
+    }
+
+    if *seed {
+        err = torr.Seed(ctx, args[1])
+    } else {
+        err = torr.Download(ctx, args[1])
+    }
+    if errors.Is(err, context.Canceled) {
+        log.Println("stopped, progress saved")
+        return
+    }
     if err != nil {
         panic(err)
     }
 }
+
+// startDHT joins the DHT on the same port as the peer listener, keeping
+// the routing table in the user's cache directory.
+func startDHT(port int, bootstrap []string) *dht.Server {
+    config := dht.Config{
+        Addr: fmt.Sprintf(":%d", port),
+        BootstrapNodes: bootstrap,
+    }
+    if dir, err := os.UserCacheDir(); err == nil {
+        dir = filepath.Join(dir, "torreja")
+        if os.MkdirAll(dir, 0755) == nil {
+            config.StatePath = filepath.Join(dir, "dht.dat")
+        }
+    }
+
+    d, err := dht.New(config)
+    if err != nil {
+        log.Printf("not using the dht: %v", err)
+        return nil
+    }
+    err = d.Bootstrap()
+    if err != nil {
+        log.Printf("dht bootstrap: %v", err)
+    }
+    return d
+}
+
+func verify(args []string) int {
+    if len(args) != 2 {
+        usage()
+        return exitError
+    }
+
+    torr, err := torrent.New(args[0])
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return exitError
+    }
+    report, err := torr.Verify(args[1])
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return exitError
+    }
+
+    for _, idx := range report.BadPieces {
+        fmt.Printf("bad piece %d\n", idx)
+    }
+    for _, path := range report.BadFiles {
+        fmt.Printf("bad file %s\n", path)
+    }
+    if !report.Ok() {
+        fmt.Printf("%d of %d pieces failed\n", len(report.BadPieces), report.NumPieces)
+        return exitBadData
+    }
+    fmt.Printf("all %d pieces ok\n", report.NumPieces)
+    return exitOk
+}
+
+func scrape(args []string) int {
+    if len(args) == 0 {
+        usage()
+        return exitError
+    }
+
+    if len(args) == 1 {
+        torr, err := torrent.New(args[0])
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            return exitError
+        }
+        res, err := torr.Scrape(context.Background())
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            return exitError
+        }
+        printScrape(torr.InfoHash, res)
+        return exitOk
+    }
+
+    infoHashes := [][20]byte{}
+    for _, arg := range args[1:] {
+        raw, err := hex.DecodeString(arg)
+        if err != nil || len(raw) != 20 {
+            fmt.Fprintf(os.Stderr, "invalid info hash %q\n", arg)
+            return exitError
+        }
+        var infoHash [20]byte
+        copy(infoHash[:], raw)
+        infoHashes = append(infoHashes, infoHash)
+    }
+
+    results, err := torrent.Scrape(context.Background(), args[0], infoHashes)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return exitError
+    }
+    for _, infoHash := range infoHashes {
+        res, ok := results[infoHash]
+        if !ok {
+            fmt.Printf("%x not found\n", infoHash)
+            continue
+        }
+        printScrape(infoHash, res)
+    }
+    return exitOk
+}
+
+func printScrape(infoHash [20]byte, res torrent.ScrapeResult) {
+    fmt.Printf("%x seeders %d leechers %d downloaded %d", infoHash, res.Complete, res.Incomplete, res.Downloaded)
+    if res.Name != "" {
+        fmt.Printf(" (%s)", res.Name)
+    }
+    fmt.Println()
+}
@@ -2,7 +2,6 @@ package message
 
 import (
     "encoding/binary"
-    "errors"
     "fmt"
     "io"
 )
@@ -19,6 +18,22 @@ const (
     IdCancel
 )
 
+// Fast Extension, BEP 6
+const (
+    IdSuggest = 0x0D + iota
+    IdHaveAll
+    IdHaveNone
+    IdReject
+    IdAllowedFast
+)
+
+// extension protocol, BEP 10
+const IdExtended = 20
+
+// Longest message Read accepts: room for a block or a metadata piece with
+// its headers, or a bitfield of up to 8M pieces.
+const maxLength = 1<<17 + 1<<20
+
 type Message struct {
     Id      int
     Payload []byte
@@ -43,8 +58,12 @@ func Read(r io.Reader) (*Message, error) {
         return nil, err
     }
     messageLen := binary.BigEndian.Uint32(lengthBuf)
+    // keep-alive
     if messageLen == 0 {
-        return nil, errors.New("length of message cannot be 0")
+        return nil, nil
+    }
+    if messageLen > maxLength {
+        return nil, fmt.Errorf("message length %d exceeds limit of %d", messageLen, maxLength)
     }
 
     messageBuf := make([]byte, messageLen)
@@ -63,6 +82,24 @@ func ParseHave(m *Message) (int, error) {
     if m.Id != IdHave {
         return 0, fmt.Errorf("expected have (id %d), got %d", IdHave, m.Id)
     }
+    return parseIndex(m)
+}
+
+func ParseSuggest(m *Message) (int, error) {
+    if m.Id != IdSuggest {
+        return 0, fmt.Errorf("expected suggest (id %d), got %d", IdSuggest, m.Id)
+    }
+    return parseIndex(m)
+}
+
+func ParseAllowedFast(m *Message) (int, error) {
+    if m.Id != IdAllowedFast {
+        return 0, fmt.Errorf("expected allowed fast (id %d), got %d", IdAllowedFast, m.Id)
+    }
+    return parseIndex(m)
+}
+
+func parseIndex(m *Message) (int, error) {
     if len(m.Payload) != 4 {
         return 0, fmt.Errorf("expected payload of length 4, got length %d", len(m.Payload))
     }
@@ -94,21 +131,102 @@ func ParsePiece(idx int, buf []byte, m *Message) (int64, error) {
 }
 
 func FormatHave(idx int) *Message {
+    return formatIndex(IdHave, idx)
+}
+
+func FormatSuggest(idx int) *Message {
+    return formatIndex(IdSuggest, idx)
+}
+
+func FormatAllowedFast(idx int) *Message {
+    return formatIndex(IdAllowedFast, idx)
+}
+
+func formatIndex(id int, idx int) *Message {
     buf := make([]byte, 4)
     binary.BigEndian.PutUint32(buf, uint32(idx))
     return &Message{
-        Id: IdHave,
+        Id: id,
         Payload: buf,
     }
 }
 
+func FormatHaveAll() *Message {
+    return &Message{Id: IdHaveAll}
+}
+
+func FormatHaveNone() *Message {
+    return &Message{Id: IdHaveNone}
+}
+
 func FormatRequest(idx int, requestedBytes, blockSize int64) *Message {
+    return formatBlock(IdRequest, idx, requestedBytes, blockSize)
+}
+
+func FormatCancel(idx int, begin, length int64) *Message {
+    return formatBlock(IdCancel, idx, begin, length)
+}
+
+func FormatReject(idx int, begin, length int64) *Message {
+    return formatBlock(IdReject, idx, begin, length)
+}
+
+func formatBlock(id int, idx int, begin, length int64) *Message {
     buf := make([]byte, 12)
     binary.BigEndian.PutUint32(buf[0:4], uint32(idx))
-    binary.BigEndian.PutUint32(buf[4:8], uint32(requestedBytes))
-    binary.BigEndian.PutUint32(buf[8:12], uint32(blockSize))
+    binary.BigEndian.PutUint32(buf[4:8], uint32(begin))
+    binary.BigEndian.PutUint32(buf[8:12], uint32(length))
+    return &Message{
+        Id: id,
+        Payload: buf,
+    }
+}
+
+func ParseRequest(m *Message) (int, int64, int64, error) {
+    if m.Id != IdRequest {
+        return 0, 0, 0, fmt.Errorf("expected request (id %d), got %d", IdRequest, m.Id)
+    }
+    return parseBlock(m)
+}
+
+func ParseCancel(m *Message) (int, int64, int64, error) {
+    if m.Id != IdCancel {
+        return 0, 0, 0, fmt.Errorf("expected cancel (id %d), got %d", IdCancel, m.Id)
+    }
+    return parseBlock(m)
+}
+
+func ParseReject(m *Message) (int, int64, int64, error) {
+    if m.Id != IdReject {
+        return 0, 0, 0, fmt.Errorf("expected reject (id %d), got %d", IdReject, m.Id)
+    }
+    return parseBlock(m)
+}
+
+func parseBlock(m *Message) (int, int64, int64, error) {
+    if len(m.Payload) != 12 {
+        return 0, 0, 0, fmt.Errorf("expected payload of length 12, got length %d", len(m.Payload))
+    }
+    idx := int(binary.BigEndian.Uint32(m.Payload[0:4]))
+    begin := int64(binary.BigEndian.Uint32(m.Payload[4:8]))
+    length := int64(binary.BigEndian.Uint32(m.Payload[8:12]))
+    return idx, begin, length, nil
+}
+
+func FormatPiece(idx int, begin int64, data []byte) *Message {
+    buf := make([]byte, 8+len(data))
+    binary.BigEndian.PutUint32(buf[0:4], uint32(idx))
+    binary.BigEndian.PutUint32(buf[4:8], uint32(begin))
+    copy(buf[8:], data)
     return &Message{
-        Id: IdRequest,
+        Id: IdPiece,
         Payload: buf,
     }
 }
+
+func FormatBitfield(bitfield []byte) *Message {
+    return &Message{
+        Id: IdBitfield,
+        Payload: bitfield,
+    }
+}
@@ -0,0 +1,267 @@
+package metadata
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha1"
+    "errors"
+    "fmt"
+    "net"
+    "time"
+
+    "github.com/lauchimoon/torreja/bencode"
+    "github.com/lauchimoon/torreja/extension"
+    "github.com/lauchimoon/torreja/handshake"
+    "github.com/lauchimoon/torreja/message"
+    "github.com/lauchimoon/torreja/peers"
+)
+
+const ExtensionName = "ut_metadata"
+
+// the only extension the fetcher speaks
+var registry = extension.NewRegistry(ExtensionName)
+
+const (
+    msgRequest = iota
+    msgData
+    msgReject
+)
+
+const BlockSize = 16384
+const MaxMetadataSize = 16*1024*1024
+
+type fetcher struct {
+    conn         net.Conn
+    metadataId   byte
+    metadataSize int64
+}
+
+func Fetch(ctx context.Context, peer peers.Peer, peerId string, infoHash [20]byte) ([]byte, error) {
+    dialer := net.Dialer{Timeout: 3*time.Second}
+    conn, err := dialer.DialContext(ctx, "tcp", peer.String())
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(30*time.Second))
+    stop := context.AfterFunc(ctx, func() {
+        conn.Close()
+    })
+    defer stop()
+
+    f := fetcher{conn: conn}
+    if err := f.handshake(infoHash, peerId); err != nil {
+        return nil, err
+    }
+    if err := f.extendedHandshake(); err != nil {
+        return nil, err
+    }
+    buf, err := f.download()
+    if ctx.Err() != nil {
+        return nil, ctx.Err()
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    hash := sha1.Sum(buf)
+    if !bytes.Equal(hash[:], infoHash[:]) {
+        return nil, errors.New("metadata failed integrity check")
+    }
+    return buf, nil
+}
+
+func FetchFromPeers(ctx context.Context, peerList []peers.Peer, peerId string, infoHash [20]byte) ([]byte, error) {
+    if len(peerList) == 0 {
+        return nil, errors.New("no peers to fetch metadata from")
+    }
+
+    type result struct {
+        buf []byte
+        err error
+    }
+    results := make(chan result, len(peerList))
+    for _, peer := range peerList {
+        go func(peer peers.Peer) {
+            buf, err := Fetch(ctx, peer, peerId, infoHash)
+            results <- result{buf, err}
+        }(peer)
+    }
+
+    var lastErr error
+    for range peerList {
+        res := <- results
+        if res.err == nil {
+            return res.buf, nil
+        }
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+        lastErr = res.err
+    }
+    return nil, fmt.Errorf("could not fetch metadata from any peer: %v", lastErr)
+}
+
+func (f *fetcher) handshake(infoHash [20]byte, peerId string) error {
+    hs := handshake.New(infoHash, peerId)
+    hs.Set(handshake.Extended)
+    _, err := f.conn.Write(hs.Serialize())
+    if err != nil {
+        return err
+    }
+
+    res, err := handshake.Read(f.conn)
+    if err != nil {
+        return err
+    }
+    if !bytes.Equal(res.InfoHash[:], infoHash[:]) {
+        return fmt.Errorf("expected infohash %x but got %x", infoHash, res.InfoHash)
+    }
+    if !res.Has(handshake.Extended) {
+        return errors.New("peer does not support the extension protocol")
+    }
+    return nil
+}
+
+func (f *fetcher) extendedHandshake() error {
+    err := f.send(extension.HandshakeId, registry.Handshake().Serialize())
+    if err != nil {
+        return err
+    }
+
+    for {
+        id, payload, err := f.readExtended()
+        if err != nil {
+            return err
+        }
+        if id != extension.HandshakeId {
+            continue
+        }
+
+        h, err := extension.ParseHandshake(payload)
+        if err != nil {
+            return err
+        }
+        var ok bool
+        f.metadataId, ok = h.Id(ExtensionName)
+        if !ok {
+            return errors.New("peer does not support ut_metadata")
+        }
+        f.metadataSize = h.MetadataSize
+        if f.metadataSize <= 0 || f.metadataSize > MaxMetadataSize {
+            return fmt.Errorf("invalid metadata size %d", f.metadataSize)
+        }
+        return nil
+    }
+}
+
+func (f *fetcher) download() ([]byte, error) {
+    buf := make([]byte, f.metadataSize)
+    numPieces := int((f.metadataSize + BlockSize - 1) / BlockSize)
+    for i := 0; i < numPieces; i++ {
+        req := map[string]any{
+            "msg_type": int64(msgRequest),
+            "piece": int64(i),
+        }
+        err := f.send(f.metadataId, bencode.Encode(req))
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    localId, _ := registry.Id(ExtensionName)
+    received := 0
+    for received < numPieces {
+        id, payload, err := f.readExtended()
+        if err != nil {
+            return nil, err
+        }
+        if id != localId {
+            continue
+        }
+        // the piece data follows the bencoded dictionary
+        dict, n, err := bencode.DecodePrefix(string(payload))
+        if err != nil {
+            return nil, err
+        }
+        data := payload[n:]
+
+        msgType, _ := dict["msg_type"].(int64)
+        piece, ok := dict["piece"].(int64)
+        if !ok || piece < 0 || piece >= int64(numPieces) {
+            return nil, errors.New("invalid metadata piece index")
+        }
+        switch msgType {
+        case msgReject:
+            return nil, fmt.Errorf("peer rejected metadata piece %d", piece)
+        case msgData:
+            begin := piece*BlockSize
+            end := begin + BlockSize
+            if end > f.metadataSize {
+                end = f.metadataSize
+            }
+            if int64(len(data)) != end - begin {
+                return nil, fmt.Errorf("metadata piece %d has wrong size %d", piece, len(data))
+            }
+            copy(buf[begin:end], data)
+            received++
+        }
+    }
+    return buf, nil
+}
+
+func (f *fetcher) send(id byte, payload string) error {
+    msg := extension.Format(id, payload)
+    _, err := f.conn.Write(msg.Serialize())
+    return err
+}
+
+func (f *fetcher) readExtended() (byte, []byte, error) {
+    for {
+        msg, err := message.Read(f.conn)
+        if err != nil {
+            return 0, nil, err
+        }
+        if msg == nil || msg.Id != message.IdExtended {
+            continue
+        }
+        return extension.Parse(msg)
+    }
+}
+
+// ParseRequest returns the piece asked for by a request message, and false
+// for any other message type.
+func ParseRequest(payload []byte) (int64, bool, error) {
+    dict, _, err := bencode.DecodePrefix(string(payload))
+    if err != nil {
+        return 0, false, err
+    }
+    msgType, _ := dict["msg_type"].(int64)
+    piece, ok := dict["piece"].(int64)
+    if msgType != msgRequest {
+        return 0, false, nil
+    }
+    if !ok {
+        return 0, false, errors.New("metadata request has no piece")
+    }
+    return piece, true, nil
+}
+
+// FormatPiece answers a request for a piece of info, or rejects it if
+// the piece does not exist.
+func FormatPiece(info []byte, piece int64) string {
+    // compare piece counts first, piece*BlockSize can overflow
+    if piece < 0 || piece >= (int64(len(info)) + BlockSize - 1)/BlockSize {
+        return bencode.Encode(map[string]any{
+            "msg_type": int64(msgReject),
+            "piece": piece,
+        })
+    }
+    begin := piece*BlockSize
+    end := min(begin + BlockSize, int64(len(info)))
+    return bencode.Encode(map[string]any{
+        "msg_type": int64(msgData),
+        "piece": piece,
+        "total_size": int64(len(info)),
+    }) + string(info[begin:end])
+}
@@ -0,0 +1,141 @@
+package p2p
+
+import (
+    "log"
+    "slices"
+
+    "github.com/lauchimoon/torreja/message"
+)
+
+// Pieces are downloaded in blocks of MaxBlockSize bytes, which may come
+// from different peers. When a peer goes away only the blocks it still
+// owed us are requested again.
+
+type activePiece struct {
+    work     *pieceWork
+    buf      []byte
+    blocks   []blockState
+    received int
+}
+
+type blockState struct {
+    received   bool
+    // peers we are waiting on for the block
+    requesters []*peerConn
+}
+
+func (t *Torrent) newActivePiece(idx int) *activePiece {
+    work := t.pieceWork(idx)
+    numBlocks := (work.length + MaxBlockSize - 1) / MaxBlockSize
+    return &activePiece{
+        work: work,
+        buf: make([]byte, work.length),
+        blocks: make([]blockState, numBlocks),
+    }
+}
+
+func (a *activePiece) block(i int) blockRequest {
+    begin := int64(i)*MaxBlockSize
+    return blockRequest{a.work.idx, begin, min(MaxBlockSize, a.work.length - begin)}
+}
+
+// nextBlock picks the block p should request next: a block of a piece in
+// progress that nobody asked for, or else the first block of a new piece,
+// or else in endgame a block other peers are already on.
+func (t *Torrent) nextBlock(p *peerConn, wanted func(idx int) bool) (blockRequest, bool) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for _, idx := range t.activeOrder {
+        if !wanted(idx) {
+            continue
+        }
+        a := t.active[idx]
+        for i := range a.blocks {
+            b := &a.blocks[i]
+            if !b.received && len(b.requesters) == 0 {
+                b.requesters = append(b.requesters, p)
+                return a.block(i), true
+            }
+        }
+    }
+
+    idx, ok := t.Picker.Pick(wanted)
+    if ok {
+        a := t.newActivePiece(idx)
+        t.active[idx] = a
+        t.activeOrder = append(t.activeOrder, idx)
+        a.blocks[0].requesters = []*peerConn{p}
+        return a.block(0), true
+    }
+    return t.endgameBlock(p, wanted)
+}
+
+// needsBlock tells whether a block is still missing.
+func (t *Torrent) needsBlock(req blockRequest) bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    a, ok := t.active[req.idx]
+    return ok && !a.blocks[req.begin/MaxBlockSize].received
+}
+
+// unrequest records that p will not send a block, so that other peers can
+// request it.
+func (t *Torrent) unrequest(p *peerConn, req blockRequest) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    a, ok := t.active[req.idx]
+    if !ok {
+        return
+    }
+    b := &a.blocks[req.begin/MaxBlockSize]
+    b.requesters = slices.DeleteFunc(b.requesters, func(other *peerConn) bool {
+        return other == p
+    })
+}
+
+// blockReceived copies a block p sent into its piece. It returns the peers
+// still waiting on the same block, whose requests should be cancelled, and
+// the piece once all of its blocks are in.
+func (t *Torrent) blockReceived(p *peerConn, req blockRequest, msg *message.Message) (*activePiece, []*peerConn, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    a, ok := t.active[req.idx]
+    if !ok {
+        return nil, nil, nil
+    }
+    b := &a.blocks[req.begin/MaxBlockSize]
+    if b.received {
+        return nil, nil, nil
+    }
+    _, err := message.ParsePiece(req.idx, a.buf, msg)
+    if err != nil {
+        return nil, nil, err
+    }
+    b.received = true
+    a.received++
+    waiting := slices.DeleteFunc(b.requesters, func(other *peerConn) bool {
+        return other == p
+    })
+    b.requesters = nil
+
+    if a.received < len(a.blocks) {
+        return nil, waiting, nil
+    }
+    delete(t.active, req.idx)
+    t.activeOrder = slices.DeleteFunc(t.activeOrder, func(idx int) bool {
+        return idx == req.idx
+    })
+    return a, waiting, nil
+}
+
+// finishPiece verifies a piece whose blocks all arrived, giving it back to
+// the picker if it is corrupt.
+func (t *Torrent) finishPiece(a *activePiece) {
+    err := checkIntegrity(a.work, a.buf)
+    if err != nil {
+        log.Printf("piece %d failed integrity check\n", a.work.idx)
+        t.Picker.Return(a.work.idx)
+        return
+    }
+    t.pieceDone(a.work.idx, a.buf)
+}
@@ -0,0 +1,173 @@
+package p2p
+
+import (
+    "cmp"
+    "math/rand/v2"
+    "slices"
+    "time"
+)
+
+// Choking, as in BEP 3. Every chokeInterval the interested peers that
+// upload to us the fastest get the UploadSlots upload slots, or while
+// seeding the ones we upload to the fastest, so that peers who give back
+// get served first. One more peer picked at random is unchoked on top of
+// those and rotated every optimisticInterval, giving new peers a chance
+// to show what they can do.
+
+const UploadSlots = 4
+const chokeInterval = 10*time.Second
+const optimisticInterval = 30*time.Second
+
+func (t *Torrent) runChoker() {
+    ticker := time.NewTicker(chokeInterval)
+    defer ticker.Stop()
+    rounds := int(optimisticInterval/chokeInterval)
+    for round := 1; ; round++ {
+        select {
+        case <-ticker.C:
+            t.rechoke(round%rounds == 0)
+        case <-t.ctx.Done():
+            return
+        }
+    }
+}
+
+// rechoke decides which peers are unchoked, picking a new optimistic
+// unchoke if rotate is set or the current one is gone.
+func (t *Torrent) rechoke(rotate bool) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    seeding := t.donePieces == len(t.PieceHashes)
+    speed := func(p *peerConn) int64 {
+        if seeding {
+            return p.uploadSpeed.Load()
+        }
+        return p.downloadSpeed.Load()
+    }
+
+    interested := []*peerConn{}
+    for _, p := range t.conns {
+        if p == nil {
+            continue
+        }
+        if p.peerInterested.Load() {
+            interested = append(interested, p)
+        } else {
+            p.unchoke.Store(false)
+        }
+    }
+    // on ties peers keep their regular slots, which matters when nobody
+    // uploads
+    regular := func(p *peerConn) bool {
+        return p.unchoke.Load() && p != t.optimistic
+    }
+    slices.SortFunc(interested, func(a, b *peerConn) int {
+        return cmp.Or(cmp.Compare(speed(b), speed(a)), compareBool(regular(b), regular(a)))
+    })
+
+    n := min(UploadSlots, len(interested))
+    for _, p := range interested[:n] {
+        p.unchoke.Store(true)
+    }
+    rest := interested[n:]
+    if rotate || !slices.Contains(rest, t.optimistic) {
+        // someone else gets the turn if there is anyone else
+        candidates := slices.DeleteFunc(slices.Clone(rest), func(p *peerConn) bool {
+            return p == t.optimistic
+        })
+        if len(candidates) == 0 {
+            candidates = rest
+        }
+        t.optimistic = nil
+        if len(candidates) > 0 {
+            t.optimistic = candidates[rand.IntN(len(candidates))]
+        }
+    }
+    for _, p := range rest {
+        p.unchoke.Store(p == t.optimistic)
+    }
+}
+
+func compareBool(a, b bool) int {
+    switch {
+    case a == b:
+        return 0
+    case a:
+        return 1
+    }
+    return -1
+}
+
+// unchokeIfFree makes a peer that became interested the optimistic
+// unchoke right away if that slot is empty, instead of leaving it waiting
+// for the next round. Regular slots are only given out by rechoke.
+func (t *Torrent) unchokeIfFree(p *peerConn) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if p.unchoke.Load() {
+        return
+    }
+    if t.optimistic != nil && t.optimistic.peerInterested.Load() {
+        for _, other := range t.conns {
+            if other == t.optimistic {
+                return
+            }
+        }
+    }
+    t.optimistic = p
+    p.unchoke.Store(true)
+}
+
+// updateChoke chokes or unchokes the peer as the choker decided. Requests
+// waiting on a peer being choked are dropped, and with the Fast Extension
+// rejected, unless they are for allowed fast pieces.
+func (p *peerConn) updateChoke() error {
+    unchoke := p.unchoke.Load()
+    if unchoke == !p.client.Choking {
+        return nil
+    }
+    p.client.Choking = !unchoke
+    if unchoke {
+        return p.client.SendUnchoked()
+    }
+    err := p.client.SendChoked()
+    if err != nil {
+        return err
+    }
+    kept := []blockRequest{}
+    for _, req := range p.requests {
+        if p.allowedFast[req.idx] {
+            kept = append(kept, req)
+            continue
+        }
+        err = p.reject(req)
+        if err != nil {
+            return err
+        }
+    }
+    p.requests = kept
+    return nil
+}
+
+// updateInterest tells the peer whether it has pieces we are missing.
+func (p *peerConn) updateInterest() error {
+    interested := false
+    for idx := range p.t.PieceHashes {
+        if p.client.Bitfield.HasPiece(idx) && !p.t.Storage.IsComplete(idx) {
+            interested = true
+            break
+        }
+    }
+    if interested == p.client.Interested {
+        return nil
+    }
+    return p.setInterested(interested)
+}
+
+func (p *peerConn) setInterested(interested bool) error {
+    p.client.Interested = interested
+    if interested {
+        return p.client.SendInterested()
+    }
+    return p.client.SendNotInterested()
+}
@@ -0,0 +1,35 @@
+package p2p
+
+import "testing"
+
+func TestUnchokeIfFree(t *testing.T) {
+    torrent := &Torrent{conns: make(map[string]*peerConn)}
+    // regular slots are free, but only rechoke hands them out
+    regular := &peerConn{t: torrent}
+    regular.unchoke.Store(true)
+    regular.peerInterested.Store(true)
+    torrent.conns["regular"] = regular
+
+    first := &peerConn{t: torrent}
+    first.peerInterested.Store(true)
+    torrent.conns["first"] = first
+    torrent.unchokeIfFree(first)
+    if !first.unchoke.Load() || torrent.optimistic != first {
+        t.Fatal("first interested peer did not get the empty optimistic slot")
+    }
+
+    second := &peerConn{t: torrent}
+    second.peerInterested.Store(true)
+    torrent.conns["second"] = second
+    torrent.unchokeIfFree(second)
+    if second.unchoke.Load() {
+        t.Error("second peer was unchoked while the optimistic slot was taken")
+    }
+
+    // the slot frees up when the optimistic peer leaves
+    delete(torrent.conns, "first")
+    torrent.unchokeIfFree(second)
+    if !second.unchoke.Load() || torrent.optimistic != second {
+        t.Error("peer did not get the optimistic slot after it was freed")
+    }
+}
@@ -0,0 +1,42 @@
+package p2p
+
+import (
+    "slices"
+)
+
+// Once every missing block has been requested, peers with nothing left to
+// do request blocks other peers are already on (endgame). Whoever sends
+// the block first wins, and the others are cancelled, so a slow peer
+// cannot hold up the last pieces.
+
+// endgameBlock returns the missing block of a piece for which has is true
+// that the fewest peers are on, leaving out the ones p already requested.
+// It is called with t.mu held.
+func (t *Torrent) endgameBlock(p *peerConn, has func(idx int) bool) (blockRequest, bool) {
+    if t.donePieces + len(t.active) < len(t.PieceHashes) {
+        return blockRequest{}, false
+    }
+
+    var best *blockState
+    var req blockRequest
+    for _, idx := range t.activeOrder {
+        if !has(idx) {
+            continue
+        }
+        a := t.active[idx]
+        for i := range a.blocks {
+            b := &a.blocks[i]
+            if b.received || slices.Contains(b.requesters, p) {
+                continue
+            }
+            if best == nil || len(b.requesters) < len(best.requesters) {
+                best, req = b, a.block(i)
+            }
+        }
+    }
+    if best == nil {
+        return blockRequest{}, false
+    }
+    best.requesters = append(best.requesters, p)
+    return req, true
+}
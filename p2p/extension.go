@@ -0,0 +1,195 @@
+package p2p
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/lauchimoon/torreja/extension"
+    "github.com/lauchimoon/torreja/message"
+    "github.com/lauchimoon/torreja/metadata"
+    "github.com/lauchimoon/torreja/peers"
+    "github.com/lauchimoon/torreja/pex"
+)
+
+// Extension is an extension carried over the extension protocol (BEP 10).
+// Extensions are offered to peers under their name and given an id by the
+// torrent's registry.
+type Extension struct {
+    Name string
+    // Handle is called with the payload of every message the peer sends
+    // for the extension.
+    Handle func(c *ExtensionConn, payload []byte) error
+    // Handshake, if set, fills in our extended handshake.
+    Handshake func(t *Torrent, h *extension.Handshake)
+    // OnHandshake, if set, is called once a peer that supports the
+    // extension sent its extended handshake.
+    OnHandshake func(c *ExtensionConn) error
+    // Enabled, if set, tells whether a torrent offers the extension.
+    Enabled func(t *Torrent) bool
+}
+
+// ExtensionConn is a connection to a peer, as seen by an extension.
+type ExtensionConn struct {
+    p *peerConn
+}
+
+func (c *ExtensionConn) Torrent() *Torrent {
+    return c.p.t
+}
+
+func (c *ExtensionConn) Peer() peers.Peer {
+    return c.p.client.Peer()
+}
+
+// Remote returns the extended handshake the peer sent.
+func (c *ExtensionConn) Remote() *extension.Handshake {
+    return c.p.remote
+}
+
+// Send sends a message of the named extension, if the peer supports it.
+func (c *ExtensionConn) Send(name string, payload string) error {
+    return c.p.sendExtended(name, payload)
+}
+
+var registered = struct {
+    sync.Mutex
+    byName map[string]Extension
+}{byName: make(map[string]Extension)}
+
+// RegisterExtension makes torrents started afterwards offer ext to peers,
+// replacing any extension registered under the same name.
+func RegisterExtension(ext Extension) {
+    registered.Lock()
+    defer registered.Unlock()
+    registered.byName[ext.Name] = ext
+}
+
+func init() {
+    RegisterExtension(Extension{
+        Name: pex.ExtensionName,
+        Handle: func(c *ExtensionConn, payload []byte) error {
+            return c.p.handlePex(payload)
+        },
+        // private torrents must not exchange peers (BEP 27)
+        Enabled: func(t *Torrent) bool {
+            return !t.Private
+        },
+    })
+    RegisterExtension(Extension{
+        Name: metadata.ExtensionName,
+        Handle: func(c *ExtensionConn, payload []byte) error {
+            return c.p.handleMetadata(payload)
+        },
+        Handshake: func(t *Torrent, h *extension.Handshake) {
+            h.MetadataSize = int64(len(t.Metadata))
+        },
+        Enabled: func(t *Torrent) bool {
+            return len(t.Metadata) > 0
+        },
+    })
+}
+
+// newRegistry gives an id to every registered extension the torrent
+// offers.
+func (t *Torrent) newRegistry() *extension.Registry {
+    registered.Lock()
+    defer registered.Unlock()
+    t.offered = make(map[string]Extension)
+    names := []string{}
+    for name, ext := range registered.byName {
+        if ext.Enabled != nil && !ext.Enabled(t) {
+            continue
+        }
+        t.offered[name] = ext
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return extension.NewRegistry(names...)
+}
+
+func (p *peerConn) sendExtendedHandshake() error {
+    h := p.t.extensions.Handshake()
+    h.V = "torreja"
+    h.P = p.t.Port
+    h.Reqq = MaxQueuedRequests
+    h.YourIp = p.client.Peer().Ip
+    for _, ext := range p.t.offered {
+        if ext.Handshake != nil {
+            ext.Handshake(p.t, h)
+        }
+    }
+    p.lastSent = time.Now()
+    return p.client.Send(extension.Format(extension.HandshakeId, h.Serialize()))
+}
+
+// supports tells whether the peer said it accepts an extension.
+func (p *peerConn) supports(name string) bool {
+    if p.remote == nil {
+        return false
+    }
+    _, ok := p.remote.Id(name)
+    return ok
+}
+
+func (p *peerConn) sendExtended(name string, payload string) error {
+    if p.remote == nil {
+        return nil
+    }
+    id, ok := p.remote.Id(name)
+    if !ok {
+        return nil
+    }
+    p.lastSent = time.Now()
+    return p.client.Send(extension.Format(id, payload))
+}
+
+func (p *peerConn) handleExtended(msg *message.Message) error {
+    id, payload, err := extension.Parse(msg)
+    if err != nil {
+        return err
+    }
+    if id == extension.HandshakeId {
+        p.remote, err = extension.ParseHandshake(payload)
+        if err != nil {
+            return err
+        }
+        if p.remote.P > 0 {
+            p.listenPort.Store(p.remote.P)
+        }
+        for name, ext := range p.t.offered {
+            if ext.OnHandshake == nil || !p.supports(name) {
+                continue
+            }
+            err = ext.OnHandshake(&ExtensionConn{p})
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    if p.remote == nil {
+        return fmt.Errorf("peer sent extended message %d before the extended handshake", id)
+    }
+
+    name, ok := p.t.extensions.Name(id)
+    if !ok {
+        return nil
+    }
+    ext := p.t.offered[name]
+    if ext.Handle == nil {
+        return nil
+    }
+    return ext.Handle(&ExtensionConn{p}, payload)
+}
+
+// handleMetadata serves the info dictionary to peers that came from a
+// magnet link (BEP 9).
+func (p *peerConn) handleMetadata(payload []byte) error {
+    piece, ok, err := metadata.ParseRequest(payload)
+    if err != nil || !ok {
+        return err
+    }
+    return p.sendExtended(metadata.ExtensionName, metadata.FormatPiece(p.t.Metadata, piece))
+}
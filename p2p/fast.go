@@ -0,0 +1,53 @@
+package p2p
+
+import (
+    "crypto/sha1"
+    "encoding/binary"
+    "net"
+    "slices"
+)
+
+// pieces peers may request from us while choked (BEP 6)
+const allowedFastCount = 10
+
+// allowedFastSet computes the canonical allowed fast set of k pieces for
+// a peer at ip. Only IPv4 peers get one.
+func allowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []int {
+    ip4 := ip.To4()
+    if ip4 == nil {
+        return nil
+    }
+    k = min(k, numPieces)
+    x := append([]byte{ip4[0], ip4[1], ip4[2], 0}, infoHash[:]...)
+    set := []int{}
+    for len(set) < k {
+        hash := sha1.Sum(x)
+        x = hash[:]
+        for i := 0; i < 5 && len(set) < k; i++ {
+            idx := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+            if !slices.Contains(set, idx) {
+                set = append(set, idx)
+            }
+        }
+    }
+    return set
+}
+
+// sendAllowedFast tells a peer using the Fast Extension which of the
+// pieces we have it may request even while choked.
+func (p *peerConn) sendAllowedFast() error {
+    if !p.client.Fast() {
+        return nil
+    }
+    for _, idx := range allowedFastSet(p.client.Peer().Ip, p.t.InfoHash, len(p.t.PieceHashes), allowedFastCount) {
+        if !p.t.Storage.IsComplete(idx) {
+            continue
+        }
+        p.allowedFast[idx] = true
+        err := p.client.SendAllowedFast(idx)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,38 @@
+package p2p
+
+import (
+    "net"
+    "slices"
+    "testing"
+)
+
+// example from BEP 6
+func TestAllowedFastSet(t *testing.T) {
+    var infoHash [20]byte
+    for i := range infoHash {
+        infoHash[i] = 0xaa
+    }
+    ip := net.IPv4(80, 4, 4, 200)
+
+    got := allowedFastSet(ip, infoHash, 1313, 7)
+    want := []int{1059, 431, 808, 1217, 287, 376, 1188}
+    if !slices.Equal(got, want) {
+        t.Errorf("got %v, want %v", got, want)
+    }
+    got = allowedFastSet(ip, infoHash, 1313, 9)
+    want = append(want, 353, 508)
+    if !slices.Equal(got, want) {
+        t.Errorf("got %v, want %v", got, want)
+    }
+}
+
+func TestAllowedFastSetSmallTorrent(t *testing.T) {
+    got := allowedFastSet(net.IPv4(10, 0, 0, 1), [20]byte{1}, 3, allowedFastCount)
+    slices.Sort(got)
+    if !slices.Equal(got, []int{0, 1, 2}) {
+        t.Errorf("got %v, want every piece", got)
+    }
+    if got := allowedFastSet(net.ParseIP("2001:db8::1"), [20]byte{1}, 100, allowedFastCount); got != nil {
+        t.Errorf("got %v for an IPv6 peer, want none", got)
+    }
+}
@@ -0,0 +1,30 @@
+package p2p
+
+import (
+    "net"
+
+    "github.com/lauchimoon/torreja/ratelimit"
+)
+
+// Limits are the rate limiters connections go through, counting every
+// byte sent and received. Any of them may be nil for no limit, and their
+// rates may be changed while the torrent runs.
+type Limits struct {
+    // shared by every torrent
+    GlobalUpload   *ratelimit.Limiter
+    GlobalDownload *ratelimit.Limiter
+    // this torrent
+    Upload         *ratelimit.Limiter
+    Download       *ratelimit.Limiter
+    // each peer gets limiters of its own following these rates
+    PeerUpload     *ratelimit.Limiter
+    PeerDownload   *ratelimit.Limiter
+}
+
+// wrap puts the connection to a peer behind the limiters, before the
+// handshake so that every byte is counted.
+func (l *Limits) wrap(conn net.Conn) *ratelimit.Conn {
+    read := []*ratelimit.Limiter{l.GlobalDownload, l.Download, ratelimit.Follow(l.PeerDownload)}
+    write := []*ratelimit.Limiter{l.GlobalUpload, l.Upload, ratelimit.Follow(l.PeerUpload)}
+    return ratelimit.NewConn(conn, read, write)
+}
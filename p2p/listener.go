@@ -0,0 +1,104 @@
+package p2p
+
+import (
+    "log"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/lauchimoon/torreja/client"
+    "github.com/lauchimoon/torreja/handshake"
+)
+
+// Listener accepts inbound peer connections and hands each one to the
+// torrent whose info hash it asks for.
+type Listener struct {
+    listener net.Listener
+    mu       sync.Mutex
+    torrents map[[20]byte]*Torrent
+}
+
+func Listen(addr string) (*Listener, error) {
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    return &Listener{
+        listener: listener,
+        torrents: make(map[[20]byte]*Torrent),
+    }, nil
+}
+
+func (l *Listener) Port() int64 {
+    return int64(l.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (l *Listener) Add(t *Torrent) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.torrents[t.InfoHash] = t
+}
+
+func (l *Listener) Remove(t *Torrent) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.torrents[t.InfoHash] == t {
+        delete(l.torrents, t.InfoHash)
+    }
+}
+
+func (l *Listener) Serve() error {
+    for {
+        conn, err := l.listener.Accept()
+        if err != nil {
+            return err
+        }
+        go l.handle(conn)
+    }
+}
+
+func (l *Listener) Close() error {
+    return l.listener.Close()
+}
+
+func (l *Listener) handle(conn net.Conn) {
+    conn.SetDeadline(time.Now().Add(5*time.Second))
+    hs, err := handshake.Read(conn)
+    if err != nil {
+        conn.Close()
+        return
+    }
+    conn.SetDeadline(time.Time{})
+
+    l.mu.Lock()
+    t, ok := l.torrents[hs.InfoHash]
+    l.mu.Unlock()
+    if !ok || hs.Pstr != "BitTorrent protocol" || hs.PeerId == t.PeerId {
+        conn.Close()
+        return
+    }
+
+    // the handshake was read before we knew which limits apply
+    limited := t.Limits.wrap(conn)
+    limited.Received(len(hs.Serialize()))
+    c, err := client.Accept(limited, hs, t.PeerId)
+    if err != nil {
+        limited.Close()
+        return
+    }
+    t.accept(c)
+}
+
+func (t *Torrent) accept(c *client.Client) {
+    defer c.Conn.Close()
+    t.start()
+
+    key := c.Conn.RemoteAddr().String()
+    if !t.reserveConn(key) {
+        return
+    }
+    defer t.removeConn(key)
+
+    log.Printf("accepted connection from %s.\n", c.Peer().Ip)
+    t.runPeer(key, c, false)
+}
@@ -2,19 +2,24 @@ package p2p
 
 import (
     "bytes"
+    "context"
     "crypto/sha1"
     "fmt"
     "runtime"
     "log"
-    "time"
+    "net"
+    "sync"
+    "sync/atomic"
 
     "github.com/lauchimoon/torreja/client"
+    "github.com/lauchimoon/torreja/extension"
     "github.com/lauchimoon/torreja/peers"
-    "github.com/lauchimoon/torreja/message"
+    "github.com/lauchimoon/torreja/storage"
+    bf "github.com/lauchimoon/torreja/bitfield"
 )
 
 const MaxBlockSize = 16384
-const MaxPipelined = 5
+const MaxConns = 50
 
 type Torrent struct {
     Peers       []peers.Peer
@@ -24,6 +29,51 @@ type Torrent struct {
     PieceLength int64
     Length      int64
     Name        string
+    // verified pieces are written here as soon as they arrive
+    Storage     storage.Storage
+    // keep connections open after the download to upload to peers
+    Seeding     bool
+    // no peer exchange for private torrents
+    Private     bool
+    // port we accept connections on, told to peers
+    Port        int64
+    // decides which piece to download next, rarest first if nil
+    Picker      Picker
+    // rate limits of the connections to peers
+    Limits      Limits
+    // bencoded info dictionary, served to peers that only have the hash
+    Metadata    []byte
+
+    startOnce  sync.Once
+    // done once the download is cancelled, ending every connection
+    ctx        context.Context
+    cancel     context.CancelFunc
+    // connection goroutines, waited for when shutting down
+    running    sync.WaitGroup
+    mu         sync.Mutex
+    closed     bool
+    extensions *extension.Registry
+    // extensions given an id in the registry, by name
+    offered    map[string]Extension
+    conns      map[string]*peerConn
+    // pieces in progress, and the order they were started in
+    active      map[int]*activePiece
+    activeOrder []int
+    donePieces int
+    // peer unchoked by the choker regardless of its rate
+    optimistic *peerConn
+    doneBytes  int64
+    complete   chan struct{}
+    errs       chan error
+    uploaded   atomic.Int64
+    downloaded atomic.Int64
+}
+
+type Stats struct {
+    Uploaded   int64
+    Downloaded int64
+    Left       int64
+    Peers      int
 }
 
 type pieceWork struct {
@@ -32,47 +82,137 @@ type pieceWork struct {
     length int64
 }
 
-type pieceResult struct {
-    idx int
-    buf []byte
+func (t *Torrent) start() {
+    t.startOnce.Do(func() {
+        t.ctx, t.cancel = context.WithCancel(context.Background())
+        t.conns = make(map[string]*peerConn)
+        t.active = make(map[int]*activePiece)
+        t.extensions = t.newRegistry()
+        t.complete = make(chan struct{})
+        t.errs = make(chan error, 1)
+        if t.Picker == nil {
+            t.Picker = NewRarestFirst(len(t.PieceHashes))
+        }
+        go t.runChoker()
+        for index := range t.PieceHashes {
+            if t.Storage.IsComplete(index) {
+                t.donePieces++
+                t.doneBytes += t.calculatePieceSize(index)
+                t.Picker.Done(index)
+            }
+        }
+        if t.donePieces == len(t.PieceHashes) {
+            close(t.complete)
+        }
+    })
 }
 
-type pieceProgress struct {
-    idx        int
-    client     *client.Client
-    buf        []byte
-    downloaded int64
-    requested  int64
-    pipelined  int64
-}
+// Download returns once every piece is downloaded, or with ctx.Err() when
+// ctx is done. Every connection is closed by the time it returns.
+func (t *Torrent) Download(ctx context.Context) error {
+    t.start()
+    defer t.shutdown()
+    if t.Complete() {
+        return nil
+    }
+
+    for _, peer := range t.Peers {
+        go t.connect(peer)
+    }
 
-func (t *Torrent) Download() ([]byte, error) {
-    workQueue := make(chan *pieceWork, len(t.PieceHashes))
-    result := make(chan *pieceResult)
-    for index, hash := range t.PieceHashes {
-        length := t.calculatePieceSize(index)
-        workQueue <- &pieceWork{index, hash, length}
+    select {
+    case <-t.complete:
+        return nil
+    case err := <-t.errs:
+        return err
+    case <-ctx.Done():
+        return ctx.Err()
     }
+}
+
+// Seed uploads to peers until something goes wrong or ctx is done. Pieces
+// that are still missing keep being downloaded in the meantime.
+func (t *Torrent) Seed(ctx context.Context) error {
+    t.start()
+    defer t.shutdown()
+    t.mu.Lock()
+    t.Seeding = true
+    t.mu.Unlock()
 
     for _, peer := range t.Peers {
-        go t.startDownload(peer, workQueue, result)
+        go t.connect(peer)
     }
 
-    buf := make([]byte, t.Length)
-    donePieces := 0
-    for donePieces < len(t.PieceHashes) {
-        res := <- result
-        begin, end := t.calculateBoundsForPiece(res.idx)
-        copy(buf[begin:end], res.buf)
-        donePieces++
+    select {
+    case err := <-t.errs:
+        return err
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// shutdown closes every connection and waits for their goroutines to
+// finish, so that nothing is written to storage after it returns. Writes
+// already under way are let finish rather than cut short.
+func (t *Torrent) shutdown() {
+    t.mu.Lock()
+    t.closed = true
+    t.mu.Unlock()
+    t.cancel()
+    t.running.Wait()
+}
 
-        percent := float64(donePieces)/float64(len(t.PieceHashes))*100.0
-        numPeers := runtime.NumGoroutine() - 1
-        log.Printf("(%0.2f%%) downloaded piece %#d from %#d peers", percent, res.idx, numPeers)
+// AddPeers connects to peers found after the download started, as long as
+// there is room for more connections.
+func (t *Torrent) AddPeers(list []peers.Peer) {
+    t.start()
+    for _, peer := range list {
+        go t.connect(peer)
     }
-    close(workQueue)
+}
+
+// Done is closed once every piece has been downloaded.
+func (t *Torrent) Done() <-chan struct{} {
+    t.start()
+    return t.complete
+}
 
-    return buf, nil
+func (t *Torrent) Stats() Stats {
+    t.start()
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return Stats{
+        Uploaded: t.uploaded.Load(),
+        Downloaded: t.downloaded.Load(),
+        Left: t.Length - t.doneBytes,
+        Peers: len(t.conns),
+    }
+}
+
+func (t *Torrent) Complete() bool {
+    for index := range t.PieceHashes {
+        if !t.Storage.IsComplete(index) {
+            return false
+        }
+    }
+    return true
+}
+
+func (t *Torrent) isSeeding() bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.Seeding
+}
+
+func (t *Torrent) fail(err error) {
+    select {
+    case t.errs <- err:
+    default:
+    }
+}
+
+func (t *Torrent) pieceWork(idx int) *pieceWork {
+    return &pieceWork{idx, t.PieceHashes[idx], t.calculatePieceSize(idx)}
 }
 
 func (t *Torrent) calculatePieceSize(idx int) int64 {
@@ -89,8 +229,29 @@ func (t *Torrent) calculateBoundsForPiece(idx int) (int64, int64) {
     return begin, end
 }
 
-func (t *Torrent) startDownload(peer peers.Peer, workQueue chan *pieceWork, result chan *pieceResult) {
-    c, err := client.New(peer, t.PeerId, t.InfoHash)
+func (t *Torrent) bitfield() bf.Bitfield {
+    bitfield := make(bf.Bitfield, (len(t.PieceHashes)+7)/8)
+    for index := range t.PieceHashes {
+        if t.Storage.IsComplete(index) {
+            bitfield.SetPiece(index)
+        }
+    }
+    return bitfield
+}
+
+func (t *Torrent) connect(peer peers.Peer) {
+    key := peer.String()
+    if !t.reserveConn(key) {
+        return
+    }
+    defer t.removeConn(key)
+
+    c, err := client.New(t.ctx, peer, t.PeerId, t.InfoHash, func(conn net.Conn) net.Conn {
+        return t.Limits.wrap(conn)
+    })
+    if t.ctx.Err() != nil {
+        return
+    }
     if err != nil {
         log.Printf("could not perform handshake with IP %s.\n", peer.Ip)
         return
@@ -98,64 +259,75 @@ func (t *Torrent) startDownload(peer peers.Peer, workQueue chan *pieceWork, resu
     defer c.Conn.Close()
     log.Printf("connection with %s successful.\n", peer.Ip)
 
-    c.SendUnchoked()
-    c.SendInterested()
+    t.runPeer(key, c, true)
+}
 
-    for worker := range workQueue {
-        if !c.Bitfield.HasPiece(worker.idx) {
-            workQueue <- worker
+// reserveConn claims the slot for a peer while the connection is being set
+// up, so the same peer is never connected twice.
+func (t *Torrent) reserveConn(key string) bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if _, ok := t.conns[key]; ok || len(t.conns) >= MaxConns || t.closed {
+        return false
+    }
+    // inbound connections are keyed by their remote address, but may be
+    // reachable at the one being connected to
+    for _, p := range t.conns {
+        if p == nil {
             continue
         }
-        buf, err := attemptDownload(c, worker)
-        if err != nil {
-            log.Println("exiting:", err)
-            workQueue <- worker
-            return
+        if addr, ok := p.address(); ok && addr.String() == key {
+            return false
         }
-        err = checkIntegrity(worker, buf)
-        if err != nil {
-            log.Printf("piece %d failed integrity check\n", worker.idx)
-            workQueue <- worker
-            continue
-        }
-        c.SendHave(worker.idx)
-        result <- &pieceResult{worker.idx, buf}
     }
+    t.conns[key] = nil
+    t.running.Add(1)
+    return true
 }
 
-func attemptDownload(c *client.Client, worker *pieceWork) ([]byte, error) {
-    state := pieceProgress{
-        idx: worker.idx,
-        client: c,
-        buf: make([]byte, worker.length),
-    }
-
-    c.Conn.SetDeadline(time.Now().Add(30*time.Second))
-    defer c.Conn.SetDeadline(time.Time{})
+func (t *Torrent) removeConn(key string) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    delete(t.conns, key)
+    t.running.Done()
+}
 
-    for state.downloaded < worker.length {
-        if !state.client.Choked {
-            for state.pipelined < MaxPipelined && state.requested < worker.length {
-                blockSize := int64(MaxBlockSize)
-                if worker.length - state.requested < blockSize {
-                    blockSize = worker.length - state.requested
-                }
+// pieceDone stores a verified piece and tells every connected peer about it.
+func (t *Torrent) pieceDone(idx int, buf []byte) {
+    if t.Storage.IsComplete(idx) {
+        return
+    }
+    t.Picker.Done(idx)
+    _, err := t.Storage.WriteBlock(idx, 0, buf)
+    if err == nil {
+        err = t.Storage.MarkComplete(idx)
+    }
+    if err != nil {
+        t.fail(err)
+        return
+    }
 
-                err := c.SendRequest(worker.idx, state.requested, blockSize)
-                if err != nil {
-                    return nil, err
-                }
-                state.pipelined++
-                state.requested += blockSize
-            }
+    t.mu.Lock()
+    t.donePieces++
+    t.doneBytes += int64(len(buf))
+    donePieces := t.donePieces
+    if donePieces == len(t.PieceHashes) {
+        close(t.complete)
+    }
+    conns := []*peerConn{}
+    for _, p := range t.conns {
+        if p != nil {
+            conns = append(conns, p)
         }
+    }
+    t.mu.Unlock()
 
-        err := state.readMessage()
-        if err != nil {
-            return nil, err
-        }
+    percent := float64(donePieces)/float64(len(t.PieceHashes))*100.0
+    log.Printf("(%0.2f%%) downloaded piece %d from %d peers", percent, idx, len(conns))
+
+    for _, p := range conns {
+        p.client.SendHave(idx)
     }
-    return state.buf, nil
 }
 
 func checkIntegrity(worker *pieceWork, buf []byte) error {
@@ -166,34 +338,62 @@ func checkIntegrity(worker *pieceWork, buf []byte) error {
     return nil
 }
 
-func (p *pieceProgress) readMessage() error {
-    msg, err := p.client.Read()
-    if err != nil {
-        return err
+// CheckExisting hashes the data already in storage and marks every piece
+// that matches as complete, so Download only fetches the rest.
+func (t *Torrent) CheckExisting() (int, error) {
+    isBad := make(map[int]bool)
+    for _, idx := range t.Verify(runtime.NumCPU()) {
+        isBad[idx] = true
     }
 
-    if msg == nil {
-        return nil
-    }
-
-    switch msg.Id {
-    case message.IdUnchoke:
-        p.client.Choked = false
-    case message.IdChoke:
-        p.client.Choked = true
-    case message.IdHave:
-        idx, err := message.ParseHave(msg)
-        if err != nil {
-            return err
+    valid := 0
+    for index := range t.PieceHashes {
+        if isBad[index] {
+            continue
         }
-        p.client.Bitfield.SetPiece(idx)
-    case message.IdPiece:
-        n, err := message.ParsePiece(p.idx, p.buf, msg)
+        err := t.Storage.MarkComplete(index)
         if err != nil {
-            return err
+            return valid, err
         }
-        p.downloaded += n
-        p.pipelined--
+        valid++
     }
-    return nil
+    return valid, nil
+}
+
+// Verify hashes every piece in storage on the given number of workers and
+// returns the indices of the pieces that are missing or do not match.
+func (t *Torrent) Verify(workers int) []int {
+    if workers < 1 {
+        workers = 1
+    }
+    indices := make(chan int)
+    valid := make([]bool, len(t.PieceHashes))
+
+    var wg sync.WaitGroup
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            buf := make([]byte, t.PieceLength)
+            for index := range indices {
+                worker := t.pieceWork(index)
+                _, err := t.Storage.ReadBlock(index, 0, buf[:worker.length])
+                valid[index] = err == nil && checkIntegrity(worker, buf[:worker.length]) == nil
+            }
+        }()
+    }
+
+    for index := range t.PieceHashes {
+        indices <- index
+    }
+    close(indices)
+    wg.Wait()
+
+    bad := []int{}
+    for index, ok := range valid {
+        if !ok {
+            bad = append(bad, index)
+        }
+    }
+    return bad
 }
@@ -0,0 +1,395 @@
+package p2p
+
+import (
+    "context"
+    "encoding/binary"
+    "fmt"
+    "log"
+    "sync/atomic"
+    "time"
+
+    "github.com/lauchimoon/torreja/client"
+    "github.com/lauchimoon/torreja/extension"
+    "github.com/lauchimoon/torreja/handshake"
+    "github.com/lauchimoon/torreja/message"
+    "github.com/lauchimoon/torreja/peers"
+    "github.com/lauchimoon/torreja/pex"
+    bf "github.com/lauchimoon/torreja/bitfield"
+)
+
+const requestTimeout = 30*time.Second
+const keepAliveInterval = 90*time.Second
+// how long to wait before asking again for a piece the peer rejected
+const rejectBackoff = 5*time.Second
+
+// peerConn is the state of one connection, owned by the goroutine running
+// its message loop.
+type peerConn struct {
+    t        *Torrent
+    client   *client.Client
+    // requests we sent and when, waiting for an answer
+    outstanding map[blockRequest]time.Time
+    pipeline    pipeline
+    downloadRate rate
+    uploadRate   rate
+    // requests the peer sent us, waiting to be served
+    requests []blockRequest
+    lastSent time.Time
+    // we dialed the peer, so it can be reached at its address
+    outbound bool
+
+    // when the peer last rejected a request for a piece
+    rejected map[int]time.Time
+    // pieces the peer may request while we choke it
+    allowedFast map[int]bool
+    // a message other than a keep-alive arrived, so the peer may no longer
+    // send its bitfield
+    gotMessage bool
+
+    // extended handshake of the peer, nil until it arrives
+    remote          *extension.Handshake
+    listenPort      atomic.Int64
+    pexSent         map[string]peers.Peer
+    lastPex         time.Time
+    lastPexReceived time.Time
+
+    // shared with the choker
+    peerInterested atomic.Bool
+    downloadSpeed  atomic.Int64
+    uploadSpeed    atomic.Int64
+    // whether the choker wants the peer unchoked, applied by updateChoke
+    unchoke        atomic.Bool
+}
+
+// closed channel, used to make a select case always ready
+var ready = func() chan struct{} {
+    c := make(chan struct{})
+    close(c)
+    return c
+}()
+
+func (t *Torrent) runPeer(key string, c *client.Client, outbound bool) {
+    // closing the connection unblocks reads and writes in progress
+    stop := context.AfterFunc(t.ctx, func() {
+        c.Conn.Close()
+    })
+    defer stop()
+    p := &peerConn{
+        t: t,
+        client: c,
+        lastSent: time.Now(),
+        outbound: outbound,
+        outstanding: make(map[blockRequest]time.Time),
+        rejected: make(map[int]time.Time),
+        allowedFast: make(map[int]bool),
+        pexSent: make(map[string]peers.Peer),
+    }
+    p.fixBitfield()
+
+    t.mu.Lock()
+    t.conns[key] = p
+    t.mu.Unlock()
+    defer p.close()
+
+    err := p.sendBitfield()
+    if err == nil {
+        err = p.sendAllowedFast()
+    }
+    if err == nil && c.Supports(handshake.Extended) {
+        err = p.sendExtendedHandshake()
+    }
+    if err != nil {
+        return
+    }
+
+    msgs := make(chan *message.Message)
+    errs := make(chan error, 1)
+    quit := make(chan struct{})
+    defer close(quit)
+    go readMessages(c, msgs, errs, quit)
+
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+
+    for {
+        var uploadSlot chan struct{}
+        if len(p.requests) > 0 {
+            uploadSlot = ready
+        }
+        var complete chan struct{}
+        if !t.isSeeding() {
+            complete = t.complete
+        }
+
+        select {
+        case msg := <-msgs:
+            err = p.handleMessage(msg)
+        case err = <-errs:
+        case <-uploadSlot:
+            err = p.serveRequest()
+        case <-ticker.C:
+            err = p.tick()
+        case <-complete:
+            return
+        case <-t.ctx.Done():
+            return
+        }
+        if err == nil {
+            err = p.updateChoke()
+        }
+        if err == nil {
+            err = p.download()
+        }
+        if err != nil {
+            if t.ctx.Err() == nil {
+                log.Printf("disconnecting from %s: %v\n", c.Peer().Ip, err)
+            }
+            return
+        }
+    }
+}
+
+func readMessages(c *client.Client, msgs chan *message.Message, errs chan error, quit chan struct{}) {
+    for {
+        msg, err := c.Read()
+        if err != nil {
+            errs <- err
+            return
+        }
+        select {
+        case msgs <- msg:
+        case <-quit:
+            return
+        }
+    }
+}
+
+// Peers may send a bitfield shorter than ours, pad it so that Have
+// messages for any piece can be recorded.
+func (p *peerConn) fixBitfield() {
+    size := (len(p.t.PieceHashes)+7)/8
+    if len(p.client.Bitfield) < size {
+        bitfield := make(bf.Bitfield, size)
+        copy(bitfield, p.client.Bitfield)
+        p.client.Bitfield = bitfield
+    }
+}
+
+func (p *peerConn) handleMessage(msg *message.Message) error {
+    if msg == nil {
+        return nil
+    }
+    first := !p.gotMessage
+    p.gotMessage = true
+    if !first && (msg.Id == message.IdBitfield || msg.Id == message.IdHaveAll || msg.Id == message.IdHaveNone) {
+        return fmt.Errorf("peer sent message %d after its first message", msg.Id)
+    }
+    if msg.Id >= message.IdSuggest && msg.Id <= message.IdAllowedFast && !p.client.Fast() {
+        return fmt.Errorf("peer sent fast extension message %d without supporting it", msg.Id)
+    }
+
+    switch msg.Id {
+    case message.IdUnchoke:
+        p.client.Choked = false
+        // most rejections come from being choked, try those pieces again
+        clear(p.rejected)
+    case message.IdChoke:
+        p.client.Choked = true
+        // peers without the Fast Extension drop our requests when choking
+        // us, the others reject them one by one
+        if !p.client.Fast() {
+            for req := range p.outstanding {
+                p.dropRequest(req)
+            }
+        }
+    case message.IdHave:
+        idx, err := message.ParseHave(msg)
+        if err != nil {
+            return err
+        }
+        if idx >= 0 && idx < len(p.t.PieceHashes) && !p.client.Bitfield.HasPiece(idx) {
+            p.client.Bitfield.SetPiece(idx)
+            p.t.Picker.AddPiece(idx)
+            if !p.client.Interested && !p.t.Storage.IsComplete(idx) {
+                return p.setInterested(true)
+            }
+        }
+    case message.IdBitfield:
+        p.setBitfield(msg.Payload)
+        return p.updateInterest()
+    case message.IdHaveAll:
+        p.t.Picker.RemoveBitfield(p.client.Bitfield)
+        p.client.SetHaveAll(len(p.t.PieceHashes))
+        p.t.Picker.AddBitfield(p.client.Bitfield)
+        return p.updateInterest()
+    case message.IdHaveNone:
+        p.setBitfield(nil)
+        return p.updateInterest()
+    case message.IdInterested:
+        p.client.PeerInterested = true
+        p.peerInterested.Store(true)
+        p.t.unchokeIfFree(p)
+    case message.IdNotInterested:
+        p.client.PeerInterested = false
+        p.peerInterested.Store(false)
+        p.unchoke.Store(false)
+    case message.IdSuggest:
+        // only a hint, the picker decides
+        _, err := message.ParseSuggest(msg)
+        return err
+    case message.IdAllowedFast:
+        idx, err := message.ParseAllowedFast(msg)
+        if err != nil {
+            return err
+        }
+        if idx >= 0 && idx < len(p.t.PieceHashes) {
+            p.client.AllowedFast[idx] = true
+        }
+    case message.IdReject:
+        return p.handleReject(msg)
+    case message.IdRequest:
+        return p.queueRequest(msg)
+    case message.IdCancel:
+        return p.cancelRequest(msg)
+    case message.IdExtended:
+        return p.handleExtended(msg)
+    case message.IdPiece:
+        return p.handlePiece(msg)
+    }
+    return nil
+}
+
+func (p *peerConn) tick() error {
+    p.downloadRate.sample()
+    p.uploadRate.sample()
+    p.downloadSpeed.Store(int64(p.downloadRate.value))
+    p.uploadSpeed.Store(int64(p.uploadRate.value))
+    err := p.updateInterest()
+    if err != nil {
+        return err
+    }
+    for req, sent := range p.outstanding {
+        if time.Since(sent) > requestTimeout {
+            return fmt.Errorf("timed out waiting for block %d+%d of piece %d", req.begin, req.length, req.idx)
+        }
+    }
+    if p.supports(pex.ExtensionName) && time.Since(p.lastPex) >= pex.Interval {
+        err := p.sendPex()
+        if err != nil {
+            return err
+        }
+    }
+    if time.Since(p.lastSent) > keepAliveInterval {
+        p.lastSent = time.Now()
+        return p.client.SendKeepAlive()
+    }
+    return nil
+}
+
+// download keeps the request pipeline full with blocks of pieces the peer
+// has.
+func (p *peerConn) download() error {
+    p.pruneRequests()
+    wanted := func(idx int) bool {
+        return p.client.Bitfield.HasPiece(idx) && time.Since(p.rejected[idx]) > rejectBackoff && p.canRequest(idx)
+    }
+    limit := p.pipeline.size(p.downloadRate.value, p.maxPipelined())
+    for len(p.outstanding) < limit {
+        req, ok := p.t.nextBlock(p, wanted)
+        if !ok {
+            break
+        }
+        err := p.client.SendRequest(req.idx, req.begin, req.length)
+        if err != nil {
+            return err
+        }
+        p.lastSent = time.Now()
+        p.outstanding[req] = time.Now()
+    }
+    return nil
+}
+
+// pruneRequests forgets requests for blocks that arrived from another
+// peer, which were cancelled when they did.
+func (p *peerConn) pruneRequests() {
+    for req := range p.outstanding {
+        if !p.t.needsBlock(req) {
+            delete(p.outstanding, req)
+        }
+    }
+}
+
+func (p *peerConn) handlePiece(msg *message.Message) error {
+    if len(msg.Payload) < 8 {
+        return fmt.Errorf("piece message is too short")
+    }
+    req := blockRequest{
+        idx: int(binary.BigEndian.Uint32(msg.Payload[0:4])),
+        begin: int64(binary.BigEndian.Uint32(msg.Payload[4:8])),
+        length: int64(len(msg.Payload) - 8),
+    }
+    // blocks we cancelled or gave up on may still arrive
+    sent, ok := p.outstanding[req]
+    if !ok {
+        return nil
+    }
+    delete(p.outstanding, req)
+    p.pipeline.blockReceived(time.Since(sent))
+    p.downloadRate.add(req.length)
+    p.t.downloaded.Add(req.length)
+
+    piece, waiting, err := p.t.blockReceived(p, req, msg)
+    if err != nil {
+        return err
+    }
+    for _, other := range waiting {
+        other.client.SendCancel(req.idx, req.begin, req.length)
+    }
+    if piece != nil {
+        p.t.finishPiece(piece)
+    }
+    return nil
+}
+
+// canRequest tells whether blocks of a piece may be requested: always when
+// unchoked, and only for allowed fast pieces when choked.
+func (p *peerConn) canRequest(idx int) bool {
+    return !p.client.Choked || p.client.AllowedFast[idx]
+}
+
+// handleReject lets another peer download the block.
+func (p *peerConn) handleReject(msg *message.Message) error {
+    idx, begin, length, err := message.ParseReject(msg)
+    if err != nil {
+        return err
+    }
+    req := blockRequest{idx, begin, length}
+    if _, ok := p.outstanding[req]; !ok {
+        return nil
+    }
+    p.rejected[idx] = time.Now()
+    p.dropRequest(req)
+    return nil
+}
+
+func (p *peerConn) dropRequest(req blockRequest) {
+    delete(p.outstanding, req)
+    p.t.unrequest(p, req)
+}
+
+// setBitfield replaces what we know the peer has, keeping the picker's
+// availability counts in step.
+func (p *peerConn) setBitfield(bitfield bf.Bitfield) {
+    p.t.Picker.RemoveBitfield(p.client.Bitfield)
+    p.client.Bitfield = bitfield
+    p.fixBitfield()
+    p.t.Picker.AddBitfield(p.client.Bitfield)
+}
+
+// close gives the blocks the peer still owed us to other peers.
+func (p *peerConn) close() {
+    for req := range p.outstanding {
+        p.dropRequest(req)
+    }
+    p.t.Picker.RemoveBitfield(p.client.Bitfield)
+}
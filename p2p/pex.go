@@ -0,0 +1,97 @@
+package p2p
+
+import (
+    "time"
+
+    "github.com/lauchimoon/torreja/peers"
+    "github.com/lauchimoon/torreja/pex"
+)
+
+// handlePex connects to the peers the other side knows about. Messages
+// that come faster than the BEP allows are ignored.
+func (p *peerConn) handlePex(payload []byte) error {
+    if time.Since(p.lastPexReceived) < pex.Interval/2 {
+        return nil
+    }
+    p.lastPexReceived = time.Now()
+
+    msg, err := pex.Parse(payload)
+    if err != nil {
+        return err
+    }
+    added := msg.Added
+    if len(added) > pex.MaxPeers {
+        added = added[:pex.MaxPeers]
+    }
+    p.t.AddPeers(added)
+    return nil
+}
+
+// sendPex tells the peer which peers we connected to or lost since the
+// last message.
+func (p *peerConn) sendPex() error {
+    p.lastPex = time.Now()
+    current, flags := p.t.swarm(p)
+
+    msg := &pex.Message{}
+    for key, peer := range current {
+        if len(msg.Added) == pex.MaxPeers {
+            break
+        }
+        if _, ok := p.pexSent[key]; !ok {
+            msg.Added = append(msg.Added, peer)
+            msg.AddedFlags = append(msg.AddedFlags, flags[key])
+            p.pexSent[key] = peer
+        }
+    }
+    for key, peer := range p.pexSent {
+        if len(msg.Dropped) == pex.MaxPeers {
+            break
+        }
+        if _, ok := current[key]; !ok {
+            msg.Dropped = append(msg.Dropped, peer)
+            delete(p.pexSent, key)
+        }
+    }
+    if len(msg.Added) == 0 && len(msg.Dropped) == 0 {
+        return nil
+    }
+    return p.sendExtended(pex.ExtensionName, msg.Serialize())
+}
+
+// swarm returns the addresses other peers can reach the connected peers
+// on, leaving out except.
+func (t *Torrent) swarm(except *peerConn) (map[string]peers.Peer, map[string]byte) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    current := make(map[string]peers.Peer)
+    flags := make(map[string]byte)
+    for _, p := range t.conns {
+        if p == nil || p == except {
+            continue
+        }
+        peer, ok := p.address()
+        if !ok {
+            continue
+        }
+        current[peer.String()] = peer
+        if p.outbound {
+            flags[peer.String()] = pex.FlagReachable
+        }
+    }
+    return current, flags
+}
+
+// address is where the peer accepts connections. For inbound connections
+// it is only known if the peer sent its port in the extended handshake.
+func (p *peerConn) address() (peers.Peer, bool) {
+    peer := p.client.Peer()
+    if p.outbound {
+        return peer, true
+    }
+    port := p.listenPort.Load()
+    if port == 0 {
+        return peer, false
+    }
+    return peers.Peer{Ip: peer.Ip, Port: port}, true
+}
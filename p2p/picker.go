@@ -0,0 +1,113 @@
+package p2p
+
+import (
+    "math/rand/v2"
+    "sync"
+
+    bf "github.com/lauchimoon/torreja/bitfield"
+)
+
+// Picker decides which piece a peer downloads next. It is used by every
+// connection at once.
+type Picker interface {
+    // Pick takes a piece for which has is true, if there is one that
+    // nobody is downloading.
+    Pick(has func(idx int) bool) (int, bool)
+    // Return gives back a piece that was taken but not finished.
+    Return(idx int)
+    // Done removes a piece that was downloaded and verified.
+    Done(idx int)
+
+    // Availability of pieces among connected peers.
+    AddBitfield(bitfield bf.Bitfield)
+    RemoveBitfield(bitfield bf.Bitfield)
+    AddPiece(idx int)
+}
+
+// rarestFirst hands out the pieces the fewest peers have first, so that
+// they spread before their holders leave. Ties are broken at random so
+// that peers do not all pick the same piece.
+type rarestFirst struct {
+    mu           sync.Mutex
+    availability []int
+    // pieces nobody has taken yet
+    pending      []bool
+}
+
+func NewRarestFirst(numPieces int) Picker {
+    r := &rarestFirst{
+        availability: make([]int, numPieces),
+        pending: make([]bool, numPieces),
+    }
+    for i := range r.pending {
+        r.pending[i] = true
+    }
+    return r
+}
+
+func (r *rarestFirst) Pick(has func(idx int) bool) (int, bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    best := -1
+    ties := 0
+    for idx, pending := range r.pending {
+        if !pending || !has(idx) {
+            continue
+        }
+        switch {
+        case best < 0 || r.availability[idx] < r.availability[best]:
+            best = idx
+            ties = 1
+        case r.availability[idx] == r.availability[best]:
+            // reservoir sampling keeps each tie equally likely
+            ties++
+            if rand.IntN(ties) == 0 {
+                best = idx
+            }
+        }
+    }
+    if best < 0 {
+        return 0, false
+    }
+    r.pending[best] = false
+    return best, true
+}
+
+func (r *rarestFirst) Return(idx int) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.pending[idx] = true
+}
+
+func (r *rarestFirst) Done(idx int) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.pending[idx] = false
+}
+
+func (r *rarestFirst) AddBitfield(bitfield bf.Bitfield) {
+    r.updateBitfield(bitfield, 1)
+}
+
+func (r *rarestFirst) RemoveBitfield(bitfield bf.Bitfield) {
+    r.updateBitfield(bitfield, -1)
+}
+
+func (r *rarestFirst) updateBitfield(bitfield bf.Bitfield, delta int) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for idx := range r.availability {
+        if bitfield.HasPiece(idx) {
+            r.availability[idx] += delta
+        }
+    }
+}
+
+func (r *rarestFirst) AddPiece(idx int) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if idx >= 0 && idx < len(r.availability) {
+        r.availability[idx]++
+    }
+}
@@ -0,0 +1,53 @@
+package p2p
+
+import (
+    "math"
+    "time"
+)
+
+// The request pipeline of a peer is sized to its bandwidth-delay product,
+// the number of blocks that arrive during one round trip, so that it never
+// runs dry waiting for our next request. It starts small and grows with
+// the measured rate, capped by the peer's reqq.
+
+const MinPipelined = 2
+// used for peers that do not advertise reqq
+const MaxPipelined = 250
+const startPipelined = 5
+
+type pipeline struct {
+    // lowest time to get a block back, which leaves out the time requests
+    // spend queued behind others
+    rtt time.Duration
+}
+
+// blockReceived records a block that took latency to arrive after being
+// requested.
+func (pl *pipeline) blockReceived(latency time.Duration) {
+    if pl.rtt == 0 || latency < pl.rtt {
+        pl.rtt = latency
+    } else {
+        // let it drift up in case the path got slower
+        pl.rtt += (latency - pl.rtt)/64
+    }
+}
+
+// size is the number of requests to keep outstanding for a peer sending
+// rate bytes per second, at most limit.
+func (pl *pipeline) size(rate float64, limit int) int {
+    n := startPipelined
+    if rate > 0 && pl.rtt > 0 {
+        // a couple of blocks more than the bandwidth-delay product, so that
+        // the pipeline grows while the rate does
+        n = int(math.Ceil(rate*pl.rtt.Seconds()/MaxBlockSize)) + 2
+    }
+    return max(MinPipelined, min(n, limit))
+}
+
+// maxPipelined is how many requests the peer allows outstanding.
+func (p *peerConn) maxPipelined() int {
+    if p.remote != nil && p.remote.Reqq > 0 {
+        return int(p.remote.Reqq)
+    }
+    return MaxPipelined
+}
@@ -0,0 +1,34 @@
+package p2p
+
+import (
+    "time"
+)
+
+// weight of the newest sample in a smoothed rate
+const rateSmoothing = 0.3
+
+// rate measures a transfer rate in bytes per second, smoothed over the
+// last few samples.
+type rate struct {
+    value   float64
+    count   int64
+    sampled time.Time
+}
+
+func (r *rate) add(n int64) {
+    r.count += n
+}
+
+// sample updates the rate from the bytes added since the last call.
+func (r *rate) sample() {
+    now := time.Now()
+    if !r.sampled.IsZero() {
+        elapsed := now.Sub(r.sampled).Seconds()
+        if elapsed > 0 {
+            current := float64(r.count)/elapsed
+            r.value += (current - r.value)*rateSmoothing
+        }
+    }
+    r.count = 0
+    r.sampled = now
+}
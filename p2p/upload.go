@@ -0,0 +1,106 @@
+package p2p
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/lauchimoon/torreja/message"
+)
+
+// most requests a peer may have waiting on us, anything above is dropped
+const MaxQueuedRequests = 250
+
+type blockRequest struct {
+    idx    int
+    begin  int64
+    length int64
+}
+
+func (p *peerConn) parseBlockRequest(idx int, begin, length int64) (blockRequest, error) {
+    if length <= 0 || length > MaxBlockSize {
+        return blockRequest{}, fmt.Errorf("peer requested block of invalid size %d", length)
+    }
+    if idx < 0 || idx >= len(p.t.PieceHashes) {
+        return blockRequest{}, fmt.Errorf("peer requested invalid piece %d", idx)
+    }
+    if begin < 0 || begin+length > p.t.calculatePieceSize(idx) {
+        return blockRequest{}, fmt.Errorf("peer requested block %d+%d out of piece %d", begin, length, idx)
+    }
+    return blockRequest{idx, begin, length}, nil
+}
+
+func (p *peerConn) queueRequest(msg *message.Message) error {
+    idx, begin, length, err := message.ParseRequest(msg)
+    if err != nil {
+        return err
+    }
+    req, err := p.parseBlockRequest(idx, begin, length)
+    if err != nil {
+        return err
+    }
+    if (p.client.Choking && !p.allowedFast[idx]) || !p.t.Storage.IsComplete(idx) || len(p.requests) >= MaxQueuedRequests {
+        return p.reject(req)
+    }
+    p.requests = append(p.requests, req)
+    return nil
+}
+
+func (p *peerConn) cancelRequest(msg *message.Message) error {
+    idx, begin, length, err := message.ParseCancel(msg)
+    if err != nil {
+        return err
+    }
+    for i, req := range p.requests {
+        if req == (blockRequest{idx, begin, length}) {
+            p.requests = append(p.requests[:i], p.requests[i+1:]...)
+            // with the Fast Extension every request gets an answer
+            return p.reject(req)
+        }
+    }
+    return nil
+}
+
+// reject tells a peer using the Fast Extension that a request will not be
+// served. Other peers are not told.
+func (p *peerConn) reject(req blockRequest) error {
+    if !p.client.Fast() {
+        return nil
+    }
+    return p.client.SendReject(req.idx, req.begin, req.length)
+}
+
+// serveRequest sends the oldest block the peer asked for.
+func (p *peerConn) serveRequest() error {
+    req := p.requests[0]
+    p.requests = p.requests[1:]
+
+    buf := make([]byte, req.length)
+    _, err := p.t.Storage.ReadBlock(req.idx, req.begin, buf)
+    if err != nil {
+        return err
+    }
+    p.lastSent = time.Now()
+    err = p.client.SendPiece(req.idx, req.begin, buf)
+    if err != nil {
+        return err
+    }
+    p.t.uploaded.Add(req.length)
+    p.uploadRate.add(req.length)
+    return nil
+}
+
+func (p *peerConn) sendBitfield() error {
+    p.t.mu.Lock()
+    donePieces := p.t.donePieces
+    p.t.mu.Unlock()
+    fast := p.client.Fast()
+    switch {
+    case donePieces == len(p.t.PieceHashes) && fast:
+        return p.client.SendHaveAll()
+    case donePieces == 0 && fast:
+        return p.client.SendHaveNone()
+    case donePieces == 0:
+        return nil
+    }
+    return p.client.SendBitfield(p.t.bitfield())
+}
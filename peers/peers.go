@@ -1,8 +1,10 @@
 package peers
 
 import (
-    "net"
+    "encoding/binary"
     "fmt"
+    "net"
+    "strconv"
 )
 
 type Peer struct {
@@ -11,5 +13,33 @@ type Peer struct {
 }
 
 func (p Peer) String() string {
-    return fmt.Sprintf("%s:%v", p.Ip.String(), p.Port)
+    return net.JoinHostPort(p.Ip.String(), strconv.FormatInt(p.Port, 10))
+}
+
+// Unmarshal parses the compact peer format: 4 bytes of IPv4 address
+// followed by a 2 byte port, for each peer.
+func Unmarshal(compact []byte) ([]Peer, error) {
+    return unmarshal(compact, net.IPv4len)
+}
+
+// Unmarshal6 is Unmarshal for 16 byte IPv6 addresses.
+func Unmarshal6(compact []byte) ([]Peer, error) {
+    return unmarshal(compact, net.IPv6len)
+}
+
+func unmarshal(compact []byte, ipLen int) ([]Peer, error) {
+    size := ipLen + 2
+    if len(compact) % size != 0 {
+        return nil, fmt.Errorf("compact peers length %d is not a multiple of %d", len(compact), size)
+    }
+    list := []Peer{}
+    for i := 0; i < len(compact); i += size {
+        ip := make(net.IP, ipLen)
+        copy(ip, compact[i:i+ipLen])
+        list = append(list, Peer{
+            Ip: ip,
+            Port: int64(binary.BigEndian.Uint16(compact[i+ipLen:i+size])),
+        })
+    }
+    return list, nil
 }
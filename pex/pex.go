@@ -0,0 +1,119 @@
+package pex
+
+import (
+    "time"
+
+    "github.com/lauchimoon/torreja/bencode"
+    "github.com/lauchimoon/torreja/peers"
+)
+
+// Peer exchange, BEP 11.
+
+const ExtensionName = "ut_pex"
+
+// Peers should not send more than one message a minute, with at most 50
+// added and 50 dropped peers in it.
+const Interval = time.Minute
+const MaxPeers = 50
+
+// flags of added peers
+const (
+    FlagEncryption = 0x01
+    FlagSeed = 0x02
+    FlagUTP = 0x04
+    FlagHolepunch = 0x08
+    FlagReachable = 0x10
+)
+
+type Message struct {
+    Added      []peers.Peer
+    // one per added peer, zero if unknown
+    AddedFlags []byte
+    Dropped    []peers.Peer
+}
+
+func Parse(payload []byte) (*Message, error) {
+    dict, err := bencode.Decode(string(payload))
+    if err != nil {
+        return nil, err
+    }
+
+    m := &Message{}
+    for _, variant := range []struct{ key string; ipLen int }{{"added", 4}, {"added6", 16}} {
+        compact, _ := dict[variant.key].(string)
+        added, err := unmarshal(compact, variant.ipLen)
+        if err != nil {
+            return nil, err
+        }
+        flags, _ := dict[variant.key + ".f"].(string)
+        for i := range added {
+            var f byte
+            if i < len(flags) {
+                f = flags[i]
+            }
+            m.AddedFlags = append(m.AddedFlags, f)
+        }
+        m.Added = append(m.Added, added...)
+    }
+    for _, variant := range []struct{ key string; ipLen int }{{"dropped", 4}, {"dropped6", 16}} {
+        compact, _ := dict[variant.key].(string)
+        dropped, err := unmarshal(compact, variant.ipLen)
+        if err != nil {
+            return nil, err
+        }
+        m.Dropped = append(m.Dropped, dropped...)
+    }
+    return m, nil
+}
+
+func unmarshal(compact string, ipLen int) ([]peers.Peer, error) {
+    if compact == "" {
+        return nil, nil
+    }
+    if ipLen == 4 {
+        return peers.Unmarshal([]byte(compact))
+    }
+    return peers.Unmarshal6([]byte(compact))
+}
+
+// Serialize encodes the message, splitting IPv4 and IPv6 peers.
+func (m *Message) Serialize() string {
+    var added, addedFlags, added6, added6Flags, dropped, dropped6 []byte
+    for i, peer := range m.Added {
+        var f byte
+        if i < len(m.AddedFlags) {
+            f = m.AddedFlags[i]
+        }
+        if peer.Ip.To4() != nil {
+            added = append(added, marshal(peer)...)
+            addedFlags = append(addedFlags, f)
+        } else {
+            added6 = append(added6, marshal(peer)...)
+            added6Flags = append(added6Flags, f)
+        }
+    }
+    for _, peer := range m.Dropped {
+        if peer.Ip.To4() != nil {
+            dropped = append(dropped, marshal(peer)...)
+        } else {
+            dropped6 = append(dropped6, marshal(peer)...)
+        }
+    }
+
+    return bencode.Encode(map[string]any{
+        "added": string(added),
+        "added.f": string(addedFlags),
+        "added6": string(added6),
+        "added6.f": string(added6Flags),
+        "dropped": string(dropped),
+        "dropped6": string(dropped6),
+    })
+}
+
+func marshal(peer peers.Peer) []byte {
+    ip := peer.Ip.To4()
+    if ip == nil {
+        ip = peer.Ip.To16()
+    }
+    return append(append([]byte{}, ip...), byte(peer.Port >> 8), byte(peer.Port))
+}
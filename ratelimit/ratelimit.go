@@ -0,0 +1,147 @@
+package ratelimit
+
+import (
+    "net"
+    "sync"
+    "time"
+)
+
+// Token bucket rate limiting. A limiter lets rate bytes per second through
+// on average, in bursts of up to one second's worth. Going over puts the
+// bucket in debt, which later users wait out, so that transfers of any
+// size can go through.
+
+type Limiter struct {
+    mu     sync.Mutex
+    rate   int64
+    // limiter whose rate this one uses
+    follow *Limiter
+    tokens float64
+    last   time.Time
+}
+
+// New returns a limiter of rate bytes per second, 0 means no limit.
+func New(rate int64) *Limiter {
+    return &Limiter{rate: rate}
+}
+
+// Follow returns a limiter with a bucket of its own that always has the
+// same rate as l, so that one rate can be applied to many connections
+// separately. It returns nil if l is nil.
+func Follow(l *Limiter) *Limiter {
+    if l == nil {
+        return nil
+    }
+    return &Limiter{follow: l}
+}
+
+// SetRate changes the rate, it can be called at any time.
+func (l *Limiter) SetRate(rate int64) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.rate = rate
+}
+
+func (l *Limiter) Rate() int64 {
+    if l.follow != nil {
+        return l.follow.Rate()
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.rate
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait
+// before using them.
+func (l *Limiter) reserve(n int) time.Duration {
+    rate := l.Rate()
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    now := time.Now()
+    if rate <= 0 {
+        l.tokens = 0
+        l.last = time.Time{}
+        return 0
+    }
+    if l.last.IsZero() {
+        l.tokens = float64(rate)
+    } else {
+        l.tokens = min(float64(rate), l.tokens + now.Sub(l.last).Seconds()*float64(rate))
+    }
+    l.last = now
+    l.tokens -= float64(n)
+    if l.tokens >= 0 {
+        return 0
+    }
+    return time.Duration(-l.tokens/float64(rate)*float64(time.Second))
+}
+
+// Wait blocks until n bytes may go through every limiter, nil ones are
+// skipped.
+func Wait(n int, limiters ...*Limiter) {
+    wait(nil, n, limiters)
+}
+
+// wait is like Wait, but gives up and returns false once done is closed.
+func wait(done chan struct{}, n int, limiters []*Limiter) bool {
+    var delay time.Duration
+    for _, l := range limiters {
+        if l != nil {
+            delay = max(delay, l.reserve(n))
+        }
+    }
+    if delay <= 0 {
+        return true
+    }
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return true
+    case <-done:
+        return false
+    }
+}
+
+// Conn limits everything read from and written to a connection.
+type Conn struct {
+    net.Conn
+    read      []*Limiter
+    write     []*Limiter
+    // closed on Close, so that nothing waits on a closed connection
+    closed    chan struct{}
+    closeOnce sync.Once
+}
+
+func NewConn(conn net.Conn, read, write []*Limiter) *Conn {
+    return &Conn{Conn: conn, read: read, write: write, closed: make(chan struct{})}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+    n, err := c.Conn.Read(b)
+    if !wait(c.closed, n, c.read) {
+        return n, net.ErrClosed
+    }
+    return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+    if !wait(c.closed, len(b), c.write) {
+        return 0, net.ErrClosed
+    }
+    return c.Conn.Write(b)
+}
+
+// Received counts n bytes that were read from the connection before it was
+// wrapped, waiting as Read would have.
+func (c *Conn) Received(n int) {
+    wait(c.closed, n, c.read)
+}
+
+func (c *Conn) Close() error {
+    c.closeOnce.Do(func() {
+        close(c.closed)
+    })
+    return c.Conn.Close()
+}
@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+    "net"
+    "testing"
+    "time"
+)
+
+func TestReserve(t *testing.T) {
+    l := New(1000)
+    // the bucket starts full
+    if d := l.reserve(1000); d != 0 {
+        t.Errorf("first second's worth waits %s, want 0", d)
+    }
+    // going over puts it in debt
+    d := l.reserve(500)
+    if d < 400*time.Millisecond || d > 500*time.Millisecond {
+        t.Errorf("500 bytes over the burst wait %s, want about 500ms", d)
+    }
+    d = l.reserve(500)
+    if d < 900*time.Millisecond || d > time.Second {
+        t.Errorf("1000 bytes in debt wait %s, want about 1s", d)
+    }
+}
+
+func TestReserveUnlimited(t *testing.T) {
+    l := New(0)
+    if d := l.reserve(1 << 30); d != 0 {
+        t.Errorf("unlimited limiter waits %s", d)
+    }
+}
+
+func TestSetRate(t *testing.T) {
+    l := New(1000)
+    l.reserve(1000)
+    l.SetRate(0)
+    if d := l.reserve(1 << 20); d != 0 {
+        t.Errorf("waits %s after removing the limit", d)
+    }
+    if l.Rate() != 0 {
+        t.Errorf("rate is %d, want 0", l.Rate())
+    }
+
+    // a new rate starts with a full bucket
+    l.SetRate(100)
+    if d := l.reserve(100); d != 0 {
+        t.Errorf("waits %s right after setting a rate", d)
+    }
+    d := l.reserve(100)
+    if d < 900*time.Millisecond || d > time.Second {
+        t.Errorf("100 bytes over a rate of 100 wait %s, want about 1s", d)
+    }
+}
+
+func TestFollow(t *testing.T) {
+    if Follow(nil) != nil {
+        t.Error("following nil should give nil")
+    }
+
+    parent := New(1000)
+    a, b := Follow(parent), Follow(parent)
+    // every follower has a bucket of its own
+    if d := a.reserve(1000); d != 0 {
+        t.Errorf("first follower waits %s", d)
+    }
+    if d := b.reserve(1000); d != 0 {
+        t.Errorf("second follower waits %s, buckets should be separate", d)
+    }
+
+    parent.SetRate(2000)
+    if a.Rate() != 2000 {
+        t.Errorf("follower rate is %d after the parent changed, want 2000", a.Rate())
+    }
+    d := a.reserve(1000)
+    if d < 400*time.Millisecond || d > 500*time.Millisecond {
+        t.Errorf("follower in debt by 1000 at 2000/s waits %s, want about 500ms", d)
+    }
+}
+
+// Closing a connection wakes up a read waiting out the limiter's debt.
+func TestConnClose(t *testing.T) {
+    client, server := net.Pipe()
+    defer server.Close()
+    conn := NewConn(client, []*Limiter{New(10)}, nil)
+
+    go server.Write(make([]byte, 1000))
+    done := make(chan error, 1)
+    go func() {
+        buf := make([]byte, 1000)
+        _, err := conn.Read(buf)
+        done <- err
+    }()
+
+    time.Sleep(50*time.Millisecond)
+    conn.Close()
+    select {
+    case err := <-done:
+        if err != net.ErrClosed {
+            t.Errorf("read returned %v, want %v", err, net.ErrClosed)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("read kept waiting after the connection was closed")
+    }
+}
@@ -0,0 +1,122 @@
+package resume
+
+import (
+    "bytes"
+    "errors"
+    "os"
+
+    "github.com/lauchimoon/torreja/bencode"
+    bf "github.com/lauchimoon/torreja/bitfield"
+    "github.com/lauchimoon/torreja/storage"
+)
+
+type File struct {
+    Length int64
+    Mtime  int64
+}
+
+// Data is the content of a fast-resume file: which pieces were verified,
+// and what the files looked like when that was written down.
+type Data struct {
+    InfoHash [20]byte
+    Pieces   bf.Bitfield
+    Files    []File
+}
+
+func Load(path string) (*Data, error) {
+    contents, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    decoded, err := bencode.Decode(string(contents))
+    if err != nil {
+        return nil, err
+    }
+
+    d := Data{}
+    infoHash, ok := decoded["info-hash"].(string)
+    if !ok || len(infoHash) != 20 {
+        return nil, errors.New("failed to parse info-hash of resume file")
+    }
+    copy(d.InfoHash[:], infoHash)
+
+    pieces, ok := decoded["pieces"].(string)
+    if !ok {
+        return nil, errors.New("failed to parse pieces of resume file")
+    }
+    d.Pieces = bf.Bitfield(pieces)
+
+    filesRaw, ok := decoded["files"].([]any)
+    if !ok {
+        return nil, errors.New("failed to parse files of resume file")
+    }
+    for _, elem := range filesRaw {
+        fRaw, ok := elem.(map[string]any)
+        if !ok {
+            return nil, errors.New("failed to parse file of resume file")
+        }
+        f := File{}
+        f.Length, ok = fRaw["length"].(int64)
+        if !ok {
+            return nil, errors.New("failed to parse file length of resume file")
+        }
+        f.Mtime, ok = fRaw["mtime"].(int64)
+        if !ok {
+            return nil, errors.New("failed to parse file mtime of resume file")
+        }
+        d.Files = append(d.Files, f)
+    }
+    return &d, nil
+}
+
+func Save(path string, d *Data) error {
+    files := []any{}
+    for _, f := range d.Files {
+        files = append(files, map[string]any{
+            "length": f.Length,
+            "mtime": f.Mtime,
+        })
+    }
+    encoded := bencode.Encode(map[string]any{
+        "info-hash": string(d.InfoHash[:]),
+        "pieces": string(d.Pieces),
+        "files": files,
+    })
+
+    // Write to a temporary file first so a crash never leaves a half
+    // written resume file behind.
+    tmp := path + ".tmp"
+    err := os.WriteFile(tmp, []byte(encoded), 0644)
+    if err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
+
+// Stat returns the current size and modification time of every file in
+// the layout.
+func Stat(layout storage.Layout) ([]File, error) {
+    files := []File{}
+    for _, f := range layout.Files {
+        info, err := os.Stat(f.Path)
+        if err != nil {
+            return nil, err
+        }
+        files = append(files, File{info.Size(), info.ModTime().UnixNano()})
+    }
+    return files, nil
+}
+
+// Matches reports whether the resume data still describes the files on
+// disk. Any change in size or mtime means the data has to be rechecked.
+func (d *Data) Matches(infoHash [20]byte, files []File) bool {
+    if !bytes.Equal(d.InfoHash[:], infoHash[:]) || len(d.Files) != len(files) {
+        return false
+    }
+    for i := range files {
+        if d.Files[i] != files[i] {
+            return false
+        }
+    }
+    return true
+}
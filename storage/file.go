@@ -0,0 +1,125 @@
+package storage
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+)
+
+type FileStorage struct {
+    completion
+    layout Layout
+    files  []*os.File
+}
+
+// NewFile creates (or reuses) every file of the layout on disk, along with
+// its parent directories.
+func NewFile(layout Layout) (*FileStorage, error) {
+    s := &FileStorage{
+        completion: newCompletion(layout.NumPieces()),
+        layout: layout,
+    }
+    for _, f := range layout.Files {
+        fh, err := openFile(f)
+        if err != nil {
+            s.Close()
+            return nil, err
+        }
+        s.files = append(s.files, fh)
+    }
+    return s, nil
+}
+
+// OpenFile opens the files of the layout read-only without creating
+// anything. Reads that touch a missing file fail.
+func OpenFile(layout Layout) (*FileStorage, error) {
+    s := &FileStorage{
+        completion: newCompletion(layout.NumPieces()),
+        layout: layout,
+    }
+    for _, f := range layout.Files {
+        fh, err := os.Open(f.Path)
+        if errors.Is(err, os.ErrNotExist) {
+            fh = nil
+        } else if err != nil {
+            s.Close()
+            return nil, err
+        }
+        s.files = append(s.files, fh)
+    }
+    return s, nil
+}
+
+func openFile(f File) (*os.File, error) {
+    err := os.MkdirAll(filepath.Dir(f.Path), 0755)
+    if err != nil {
+        return nil, err
+    }
+    fh, err := os.OpenFile(f.Path, os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return nil, err
+    }
+    // Only touch the size when it is wrong, truncating also bumps the
+    // mtime that resume data relies on.
+    info, err := fh.Stat()
+    if err != nil {
+        fh.Close()
+        return nil, err
+    }
+    if info.Size() != f.Length {
+        err = fh.Truncate(f.Length)
+        if err != nil {
+            fh.Close()
+            return nil, err
+        }
+    }
+    return fh, nil
+}
+
+func (s *FileStorage) ReadBlock(piece int, begin int64, buf []byte) (int, error) {
+    off, err := s.layout.offset(piece, begin, len(buf))
+    if err != nil {
+        return 0, err
+    }
+    n := 0
+    err = s.layout.spans(off, len(buf), func(idx int, fileOff int64, lo, hi int) error {
+        if s.files[idx] == nil {
+            return &os.PathError{Op: "read", Path: s.layout.Files[idx].Path, Err: os.ErrNotExist}
+        }
+        read, err := s.files[idx].ReadAt(buf[lo:hi], fileOff)
+        n += read
+        return err
+    })
+    return n, err
+}
+
+func (s *FileStorage) WriteBlock(piece int, begin int64, data []byte) (int, error) {
+    off, err := s.layout.offset(piece, begin, len(data))
+    if err != nil {
+        return 0, err
+    }
+    n := 0
+    err = s.layout.spans(off, len(data), func(idx int, fileOff int64, lo, hi int) error {
+        if s.files[idx] == nil {
+            return &os.PathError{Op: "write", Path: s.layout.Files[idx].Path, Err: os.ErrNotExist}
+        }
+        written, err := s.files[idx].WriteAt(data[lo:hi], fileOff)
+        n += written
+        return err
+    })
+    return n, err
+}
+
+func (s *FileStorage) Close() error {
+    var firstErr error
+    for _, f := range s.files {
+        if f == nil {
+            continue
+        }
+        if err := f.Close(); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    s.files = nil
+    return firstErr
+}
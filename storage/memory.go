@@ -0,0 +1,41 @@
+package storage
+
+type MemoryStorage struct {
+    completion
+    layout Layout
+    buf    []byte
+}
+
+// NewMemory keeps the whole torrent in RAM. File paths of the layout are
+// ignored.
+func NewMemory(layout Layout) *MemoryStorage {
+    return &MemoryStorage{
+        completion: newCompletion(layout.NumPieces()),
+        layout: layout,
+        buf: make([]byte, layout.Length()),
+    }
+}
+
+func (s *MemoryStorage) ReadBlock(piece int, begin int64, buf []byte) (int, error) {
+    off, err := s.layout.offset(piece, begin, len(buf))
+    if err != nil {
+        return 0, err
+    }
+    return copy(buf, s.buf[off:]), nil
+}
+
+func (s *MemoryStorage) WriteBlock(piece int, begin int64, data []byte) (int, error) {
+    off, err := s.layout.offset(piece, begin, len(data))
+    if err != nil {
+        return 0, err
+    }
+    return copy(s.buf[off:], data), nil
+}
+
+func (s *MemoryStorage) Bytes() []byte {
+    return s.buf
+}
+
+func (s *MemoryStorage) Close() error {
+    return nil
+}
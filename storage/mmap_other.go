@@ -0,0 +1,13 @@
+//go:build !unix
+
+package storage
+
+import "errors"
+
+type MmapStorage struct {
+    FileStorage
+}
+
+func NewMmap(layout Layout) (*MmapStorage, error) {
+    return nil, errors.New("mmap storage is not supported on this platform")
+}
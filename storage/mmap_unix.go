@@ -0,0 +1,85 @@
+//go:build unix
+
+package storage
+
+import (
+    "os"
+    "syscall"
+)
+
+type MmapStorage struct {
+    completion
+    layout  Layout
+    regions [][]byte
+}
+
+// NewMmap maps every file of the layout into memory. Files are created the
+// same way NewFile does.
+func NewMmap(layout Layout) (*MmapStorage, error) {
+    s := &MmapStorage{
+        completion: newCompletion(layout.NumPieces()),
+        layout: layout,
+    }
+    for _, f := range layout.Files {
+        region, err := mapFile(f)
+        if err != nil {
+            s.Close()
+            return nil, err
+        }
+        s.regions = append(s.regions, region)
+    }
+    return s, nil
+}
+
+func mapFile(f File) ([]byte, error) {
+    fh, err := openFile(f)
+    if err != nil {
+        return nil, err
+    }
+    // The mapping stays valid after the descriptor is closed.
+    defer fh.Close()
+    if f.Length == 0 {
+        return nil, nil
+    }
+    return syscall.Mmap(int(fh.Fd()), 0, int(f.Length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func (s *MmapStorage) ReadBlock(piece int, begin int64, buf []byte) (int, error) {
+    off, err := s.layout.offset(piece, begin, len(buf))
+    if err != nil {
+        return 0, err
+    }
+    n := 0
+    err = s.layout.spans(off, len(buf), func(idx int, fileOff int64, lo, hi int) error {
+        n += copy(buf[lo:hi], s.regions[idx][fileOff:])
+        return nil
+    })
+    return n, err
+}
+
+func (s *MmapStorage) WriteBlock(piece int, begin int64, data []byte) (int, error) {
+    off, err := s.layout.offset(piece, begin, len(data))
+    if err != nil {
+        return 0, err
+    }
+    n := 0
+    err = s.layout.spans(off, len(data), func(idx int, fileOff int64, lo, hi int) error {
+        n += copy(s.regions[idx][fileOff:], data[lo:hi])
+        return nil
+    })
+    return n, err
+}
+
+func (s *MmapStorage) Close() error {
+    var firstErr error
+    for _, region := range s.regions {
+        if region == nil {
+            continue
+        }
+        if err := syscall.Munmap(region); err != nil && firstErr == nil {
+            firstErr = os.NewSyscallError("munmap", err)
+        }
+    }
+    s.regions = nil
+    return firstErr
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+    "fmt"
+    "sync"
+
+    bf "github.com/lauchimoon/torreja/bitfield"
+)
+
+// Storage is where piece data lives. Offsets are given as a piece index
+// plus a byte offset inside that piece.
+type Storage interface {
+    ReadBlock(piece int, begin int64, buf []byte) (int, error)
+    WriteBlock(piece int, begin int64, data []byte) (int, error)
+    MarkComplete(piece int) error
+    IsComplete(piece int) bool
+    Close() error
+}
+
+type File struct {
+    Path   string
+    Length int64
+}
+
+// Layout describes how the piece space is split into files.
+type Layout struct {
+    PieceLength int64
+    Files       []File
+}
+
+func (l Layout) Length() int64 {
+    var length int64
+    for _, f := range l.Files {
+        length += f.Length
+    }
+    return length
+}
+
+func (l Layout) NumPieces() int {
+    if l.PieceLength <= 0 {
+        return 0
+    }
+    return int((l.Length() + l.PieceLength - 1) / l.PieceLength)
+}
+
+func (l Layout) offset(piece int, begin int64, size int) (int64, error) {
+    if piece < 0 || begin < 0 || begin+int64(size) > l.PieceLength {
+        return 0, fmt.Errorf("block %d+%d of piece %d is out of bounds", begin, size, piece)
+    }
+    off := int64(piece)*l.PieceLength + begin
+    if off+int64(size) > l.Length() {
+        return 0, fmt.Errorf("block %d+%d of piece %d is past the end of the torrent", begin, size, piece)
+    }
+    return off, nil
+}
+
+// spans calls fn for every file overlapping n bytes at off, with the offset
+// inside that file and the part of the buffer that belongs to it.
+func (l Layout) spans(off int64, n int, fn func(idx int, fileOff int64, lo, hi int) error) error {
+    var fileStart int64
+    pos := 0
+    for i, f := range l.Files {
+        fileEnd := fileStart + f.Length
+        if pos < n && off < fileEnd && f.Length > 0 {
+            fileOff := off - fileStart
+            size := int(min(f.Length - fileOff, int64(n - pos)))
+            err := fn(i, fileOff, pos, pos+size)
+            if err != nil {
+                return err
+            }
+            pos += size
+            off += int64(size)
+        }
+        fileStart = fileEnd
+    }
+    return nil
+}
+
+// completion keeps track of verified pieces for the implementations.
+type completion struct {
+    mu       sync.RWMutex
+    bitfield bf.Bitfield
+    n        int
+}
+
+func newCompletion(numPieces int) completion {
+    return completion{
+        bitfield: make(bf.Bitfield, (numPieces+7)/8),
+        n: numPieces,
+    }
+}
+
+func (c *completion) MarkComplete(piece int) error {
+    if piece < 0 || piece >= c.n {
+        return fmt.Errorf("piece %d is out of bounds", piece)
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.bitfield.SetPiece(piece)
+    return nil
+}
+
+func (c *completion) IsComplete(piece int) bool {
+    if piece < 0 || piece >= c.n {
+        return false
+    }
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.bitfield.HasPiece(piece)
+}
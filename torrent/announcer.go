@@ -0,0 +1,134 @@
+package torrent
+
+import (
+    "context"
+    "log"
+    "time"
+
+    "github.com/lauchimoon/torreja/p2p"
+    "github.com/lauchimoon/torreja/peers"
+)
+
+// how long to wait before trying again when no tracker answered
+const retryInterval = time.Minute
+// how long the announces sent while stopping may delay shutting down
+const stopTimeout = 5*time.Second
+
+// announcer keeps the trackers up to date with the progress of a torrent,
+// and hands the peers they return over to it.
+type announcer struct {
+    m          *Metainfo
+    torrent    *p2p.Torrent
+    trackerIds map[string]string
+    ctx        context.Context
+    cancel     context.CancelFunc
+    // whether there are trackers to keep up to date
+    running    bool
+    finished   chan struct{}
+}
+
+func (m *Metainfo) newAnnouncer(ctx context.Context, torrent *p2p.Torrent) *announcer {
+    ctx, cancel := context.WithCancel(ctx)
+    return &announcer{
+        m: m,
+        torrent: torrent,
+        trackerIds: make(map[string]string),
+        ctx: ctx,
+        cancel: cancel,
+        finished: make(chan struct{}),
+    }
+}
+
+// start sends the started event and returns the peers the trackers gave
+// us. Trackers are re-announced to in the background until stop is called.
+func (a *announcer) start() ([]peers.Peer, error) {
+    if len(a.m.tiers()) == 0 {
+        return nil, nil
+    }
+
+    wasComplete := a.torrent.Complete()
+    found, interval, err := a.m.announceTiers(a.ctx, a.request("started"), a.trackerIds)
+    if err != nil {
+        interval = retryInterval
+    }
+    a.running = true
+    go a.run(interval, wasComplete)
+    return found, err
+}
+
+func (a *announcer) run(interval time.Duration, wasComplete bool) {
+    defer close(a.finished)
+    timer := time.NewTimer(interval)
+    defer timer.Stop()
+
+    var done <-chan struct{}
+    if !wasComplete {
+        done = a.torrent.Done()
+    }
+
+    for {
+        event := ""
+        select {
+        case <-timer.C:
+        case <-done:
+            event = "completed"
+            done = nil
+        case <-a.ctx.Done():
+            // don't lose the completed event if we are stopping right
+            // after finishing
+            select {
+            case <-done:
+                a.finalAnnounce("completed")
+            default:
+            }
+            return
+        }
+
+        found, next, err := a.m.announceTiers(a.ctx, a.request(event), a.trackerIds)
+        if a.ctx.Err() != nil {
+            // stopped while announcing
+            if err != nil && event == "completed" {
+                a.finalAnnounce(event)
+            }
+            return
+        }
+        if err != nil {
+            log.Println("announce failed:", err)
+            next = retryInterval
+        } else {
+            a.torrent.AddPeers(found)
+        }
+        timer.Reset(next)
+    }
+}
+
+// stop ends the periodic announces and tells the trackers we are leaving.
+// It still does when the context the announcer was made with is done.
+func (a *announcer) stop() {
+    a.cancel()
+    if !a.running {
+        return
+    }
+    <-a.finished
+    a.finalAnnounce("stopped")
+}
+
+// finalAnnounce sends an event once the announcer's context is done, giving
+// the trackers stopTimeout to answer.
+func (a *announcer) finalAnnounce(event string) {
+    ctx, cancel := context.WithTimeout(context.WithoutCancel(a.ctx), stopTimeout)
+    defer cancel()
+    a.m.announceTiers(ctx, a.request(event), a.trackerIds)
+}
+
+func (a *announcer) request(event string) announceRequest {
+    stats := a.torrent.Stats()
+    return announceRequest{
+        PeerId: peerId,
+        Port: a.m.port(),
+        Uploaded: stats.Uploaded,
+        Downloaded: stats.Downloaded,
+        Left: stats.Left,
+        Event: event,
+    }
+}
@@ -0,0 +1,44 @@
+package torrent
+
+import (
+    "context"
+    "log"
+    "time"
+
+    "github.com/lauchimoon/torreja/p2p"
+    "github.com/lauchimoon/torreja/peers"
+)
+
+// how often the DHT is asked for peers again
+const dhtInterval = 15*time.Minute
+
+// Private torrents must only get peers from their trackers (BEP 27).
+func (m *Metainfo) useDHT() bool {
+    return m.DHT != nil && m.Info.Private != 1
+}
+
+// dhtPeers looks up peers in the DHT and announces that we have the
+// torrent on our port.
+func (m *Metainfo) dhtPeers() []peers.Peer {
+    for _, node := range m.Nodes {
+        m.DHT.AddNode(node)
+    }
+    found, err := m.DHT.Announce(m.InfoHash, m.port())
+    if err != nil {
+        log.Printf("dht: %v\n", err)
+    }
+    return found
+}
+
+func (m *Metainfo) runDHT(ctx context.Context, torrent *p2p.Torrent) {
+    ticker := time.NewTicker(dhtInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            torrent.AddPeers(m.dhtPeers())
+        case <-ctx.Done():
+            return
+        }
+    }
+}
@@ -0,0 +1,51 @@
+package torrent
+
+import (
+    "errors"
+    "fmt"
+    "path/filepath"
+    "strings"
+
+    "github.com/lauchimoon/torreja/storage"
+)
+
+// Layout maps every file of the torrent onto the piece space.
+// Single-file torrents are written to outPath itself, multi-file torrents
+// go inside outPath/<name>/.
+func (t *Metainfo) Layout(outPath string) storage.Layout {
+    layout := storage.Layout{PieceLength: t.Info.PieceLength}
+    if t.Info.mode == modeSingleFile {
+        layout.Files = []storage.File{{Path: outPath, Length: t.getTotalLength()}}
+        return layout
+    }
+
+    root := filepath.Join(outPath, t.Info.Name)
+    for _, f := range t.Info.Files {
+        layout.Files = append(layout.Files, storage.File{
+            Path: filepath.Join(root, filepath.FromSlash(f.Path)),
+            Length: f.Length,
+        })
+    }
+    return layout
+}
+
+// sanitizePath joins the components of a path from the info dictionary,
+// refusing anything that could escape the download directory.
+func sanitizePath(parts []string) (string, error) {
+    if len(parts) == 0 {
+        return "", errors.New("file path cannot be empty")
+    }
+    for _, part := range parts {
+        switch {
+        case part == "":
+            return "", fmt.Errorf("file path %q has an empty component", strings.Join(parts, "/"))
+        case part == "." || part == "..":
+            return "", fmt.Errorf("file path %q contains %q", strings.Join(parts, "/"), part)
+        case strings.ContainsAny(part, "/\\\x00"):
+            return "", fmt.Errorf("file path component %q contains a separator", part)
+        case filepath.IsAbs(part) || filepath.VolumeName(part) != "":
+            return "", fmt.Errorf("file path component %q is absolute", part)
+        }
+    }
+    return strings.Join(parts, "/"), nil
+}
@@ -0,0 +1,6 @@
+package torrent
+
+// Like the DHT, local service discovery is off for private torrents.
+func (m *Metainfo) useLSD() bool {
+    return m.LSD != nil && m.Info.Private != 1
+}
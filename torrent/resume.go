@@ -0,0 +1,75 @@
+package torrent
+
+import (
+    "log"
+    "os"
+    "path/filepath"
+
+    bf "github.com/lauchimoon/torreja/bitfield"
+    "github.com/lauchimoon/torreja/resume"
+    "github.com/lauchimoon/torreja/storage"
+)
+
+func (t *Metainfo) resumePath(outPath string) string {
+    if t.Info.mode == modeSingleFile {
+        return outPath + ".fastresume"
+    }
+    return filepath.Join(outPath, t.Info.Name) + ".fastresume"
+}
+
+// restore marks the pieces that are already on disk as complete. The
+// fast-resume file is trusted only if the files have not changed since it
+// was written, otherwise every piece is hash-checked.
+func (t *Metainfo) restore(st storage.Storage, layout storage.Layout, resumePath string) error {
+    existing, err := resume.Stat(layout)
+    if err != nil {
+        return err
+    }
+    data, err := resume.Load(resumePath)
+    if err == nil && data.Matches(t.InfoHash, existing) {
+        for index := range t.Info.Pieces {
+            if index/8 < len(data.Pieces) && data.Pieces.HasPiece(index) {
+                err = st.MarkComplete(index)
+                if err != nil {
+                    return err
+                }
+            }
+        }
+        return nil
+    }
+
+    log.Println("checking existing data...")
+    valid, err := t.p2pTorrent(st).CheckExisting()
+    if err != nil {
+        return err
+    }
+    log.Printf("%d of %d pieces already downloaded", valid, len(t.Info.Pieces))
+    return nil
+}
+
+func anyFileExists(layout storage.Layout) bool {
+    for _, f := range layout.Files {
+        if _, err := os.Stat(f.Path); err == nil {
+            return true
+        }
+    }
+    return false
+}
+
+func (t *Metainfo) saveResume(st storage.Storage, layout storage.Layout, resumePath string) error {
+    files, err := resume.Stat(layout)
+    if err != nil {
+        return err
+    }
+    pieces := make(bf.Bitfield, (len(t.Info.Pieces)+7)/8)
+    for index := range t.Info.Pieces {
+        if st.IsComplete(index) {
+            pieces.SetPiece(index)
+        }
+    }
+    return resume.Save(resumePath, &resume.Data{
+        InfoHash: t.InfoHash,
+        Pieces: pieces,
+        Files: files,
+    })
+}
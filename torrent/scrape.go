@@ -0,0 +1,133 @@
+package torrent
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net/url"
+    "path"
+    "strings"
+
+    "github.com/lauchimoon/torreja/bencode"
+)
+
+type ScrapeResult struct {
+    // number of seeders
+    Complete   int64
+    // number of times the torrent was downloaded
+    Downloaded int64
+    // number of leechers
+    Incomplete int64
+    Name       string
+}
+
+// Scrape asks the tracker behind an announce URL for the stats of every
+// info hash in a single request.
+func Scrape(ctx context.Context, announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+    u, err := url.Parse(announce)
+    if err != nil {
+        return nil, err
+    }
+    switch u.Scheme {
+    case "udp":
+        return scrapeUDP(ctx, announce, infoHashes)
+    case "http", "https":
+        return scrapeHTTP(ctx, u, infoHashes)
+    }
+    return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+}
+
+// Scrape returns the stats of the torrent from the first tracker that
+// answers.
+func (m *Metainfo) Scrape(ctx context.Context) (ScrapeResult, error) {
+    lastErr := errors.New("no trackers to scrape")
+    for _, tier := range m.tiers() {
+        for _, tracker := range tier {
+            results, err := Scrape(ctx, tracker, [][20]byte{m.InfoHash})
+            if err != nil {
+                lastErr = err
+                continue
+            }
+            res, ok := results[m.InfoHash]
+            if !ok {
+                lastErr = fmt.Errorf("tracker %s does not know the torrent", tracker)
+                continue
+            }
+            return res, nil
+        }
+    }
+    return ScrapeResult{}, lastErr
+}
+
+// scrapeURL follows the convention of replacing "announce" in the last
+// path component with "scrape". Trackers whose announce URL does not look
+// like that do not support scraping.
+func scrapeURL(announce *url.URL) (*url.URL, error) {
+    dir, last := path.Split(announce.Path)
+    if !strings.HasPrefix(last, "announce") {
+        return nil, fmt.Errorf("tracker %s does not support scrape", announce)
+    }
+    scrape := *announce
+    scrape.Path = dir + "scrape" + strings.TrimPrefix(last, "announce")
+    return &scrape, nil
+}
+
+func scrapeHTTP(ctx context.Context, announce *url.URL, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+    u, err := scrapeURL(announce)
+    if err != nil {
+        return nil, err
+    }
+    params := u.Query()
+    for _, infoHash := range infoHashes {
+        params.Add("info_hash", string(infoHash[:]))
+    }
+    u.RawQuery = params.Encode()
+
+    resp, err := httpGet(ctx, u.String())
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    bodyBytes, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    decoded, err := bencode.Decode(string(bodyBytes))
+    if err != nil {
+        return nil, err
+    }
+    err = checkFailure(decoded)
+    if err != nil {
+        return nil, err
+    }
+    return parseScrapeFiles(decoded)
+}
+
+func parseScrapeFiles(decoded map[string]any) (map[[20]byte]ScrapeResult, error) {
+    files, ok := decoded["files"].(map[string]any)
+    if !ok {
+        return nil, errors.New("failed to parse 'files' of scrape response")
+    }
+
+    results := make(map[[20]byte]ScrapeResult)
+    for key, value := range files {
+        if len(key) != 20 {
+            return nil, fmt.Errorf("invalid info hash of length %d in scrape response", len(key))
+        }
+        stats, ok := value.(map[string]any)
+        if !ok {
+            return nil, errors.New("failed to parse stats of scrape response")
+        }
+        var infoHash [20]byte
+        copy(infoHash[:], key)
+        res := ScrapeResult{}
+        getField(stats, "complete", &res.Complete)
+        getField(stats, "downloaded", &res.Downloaded)
+        getField(stats, "incomplete", &res.Incomplete)
+        getField(stats, "name", &res.Name)
+        results[infoHash] = res
+    }
+    return results, nil
+}
@@ -1,15 +1,31 @@
 package torrent
 
 import (
+    "context"
     "crypto/sha1"
     "errors"
+    "fmt"
+    "log"
+    "math/rand/v2"
+    "net"
     "os"
-    "strings"
+    "strconv"
 
     "github.com/lauchimoon/torreja/bencode"
+    "github.com/lauchimoon/torreja/dht"
+    "github.com/lauchimoon/torreja/lsd"
+    "github.com/lauchimoon/torreja/magnet"
+    "github.com/lauchimoon/torreja/metadata"
     "github.com/lauchimoon/torreja/p2p"
+    "github.com/lauchimoon/torreja/peers"
+    "github.com/lauchimoon/torreja/storage"
 )
 
+// Azureus-style peer id, random per process so that we can recognise our
+// own connections.
+var peerId = newPeerId()
+const defaultPort = 6881
+
 const (
     modeSingleFile = iota
     modeMultiFile
@@ -28,17 +44,41 @@ type info struct {
 
     Name string
     Files []file
+    mode int
 }
 
 type Metainfo struct {
     Info info
     InfoHash [20]byte
     Announce string
-    AnnounceList []string
+    // tiers of trackers, BEP 12
+    AnnounceList [][]string
+    // "host:port" of DHT nodes, BEP 5
+    Nodes []string
     CreationDate int64
     Comment string
     CreatedBy string
     Encoding string
+
+    // Inbound connections are taken from here when set, and its port is
+    // the one announced to trackers.
+    Listener *p2p.Listener
+    // Peers are also looked up in the DHT when set, unless the torrent is
+    // private.
+    DHT *dht.Server
+    // Peers on the local network are found through it when set, unless
+    // the torrent is private.
+    LSD *lsd.Service
+    // Connections to peers go through these rate limiters, whose rates can
+    // be changed while downloading.
+    Limits p2p.Limits
+
+    // peers known without asking a tracker, e.g. x.pe in magnet links
+    peers []peers.Peer
+    // length given by a magnet link, announced until the info arrives
+    magnetLength int64
+    // bencoded info dictionary
+    infoBytes []byte
 }
 
 func New(torrentFilePath string) (*Metainfo, error) {
@@ -52,13 +92,15 @@ func New(torrentFilePath string) (*Metainfo, error) {
     }
 
     metainfo := Metainfo{}
+    metainfo.AnnounceList = getAnnounceList(decoded)
+    metainfo.Nodes = getNodes(decoded)
+    // trackerless torrents have no announce and rely on the DHT
     announce, ok := decoded["announce"]
-    if !ok {
-        return nil, errors.New("no 'announce' found.")
-    }
-    metainfo.Announce, ok = announce.(string)
-    if !ok {
-        return nil, errors.New("failed to parse 'announce' as string.")
+    if ok {
+        metainfo.Announce, ok = announce.(string)
+        if !ok {
+            return nil, errors.New("failed to parse 'announce' as string.")
+        }
     }
 
     // optional fields:
@@ -68,7 +110,6 @@ func New(torrentFilePath string) (*Metainfo, error) {
     // created by
     // encoding
     // If they're not found, there's no problem.
-    metainfo.AnnounceList = getAnnounceList(decoded)
     getField(decoded, "creation date", &metainfo.CreationDate)
     getField(decoded, "comment", &metainfo.Comment)
     getField(decoded, "created by", &metainfo.CreatedBy)
@@ -85,42 +126,187 @@ func New(torrentFilePath string) (*Metainfo, error) {
         return nil, err
     }
     metainfo.InfoHash = iHash
+    metainfo.infoBytes = []byte(bencode.Encode(decoded["info"]))
 
     return &metainfo, nil
 }
 
-func (t *Metainfo) Download(outPath string) error {
-    peerId := "torrejadownloader123"
-    peers, err := t.RequestPeers(peerId, 6881)
+func NewFromMagnet(uri string) (*Metainfo, error) {
+    return NewFromMagnetWithDHT(context.Background(), uri, nil)
+}
+
+// NewFromMagnetWithDHT is like NewFromMagnet, but also looks for peers to
+// fetch the metadata from in the DHT. It gives up when ctx is done.
+func NewFromMagnetWithDHT(ctx context.Context, uri string, d *dht.Server) (*Metainfo, error) {
+    m, err := magnet.Parse(uri)
+    if err != nil {
+        return nil, err
+    }
+
+    metainfo := Metainfo{
+        InfoHash: m.InfoHash,
+        DHT: d,
+        peers: m.Peers,
+        magnetLength: m.Length,
+    }
+    // every tracker of a magnet link gets a tier of its own, so all of
+    // them are asked for peers
+    for _, tracker := range m.Trackers {
+        metainfo.AnnounceList = append(metainfo.AnnounceList, []string{tracker})
+    }
+    if len(m.Trackers) > 0 {
+        metainfo.Announce = m.Trackers[0]
+    }
+
+    peerList, err := metainfo.findPeers(ctx)
+    if err != nil {
+        return nil, err
+    }
+    raw, err := metadata.FetchFromPeers(ctx, peerList, peerId, m.InfoHash)
+    if err != nil {
+        return nil, err
+    }
+    infoDict, err := bencode.Decode(string(raw))
+    if err != nil {
+        return nil, err
+    }
+    data, err := getInfo(map[string]any{"info": infoDict})
+    if err != nil {
+        return nil, err
+    }
+    metainfo.Info = data
+    metainfo.infoBytes = raw
+
+    return &metainfo, nil
+}
+
+// Download fetches the torrent into outPath. When ctx is done it stops,
+// saving the progress made so far, and returns ctx.Err().
+func (t *Metainfo) Download(ctx context.Context, outPath string) error {
+    return t.download(ctx, outPath, false)
+}
+
+// Seed downloads whatever is missing at outPath and then keeps uploading
+// to peers until an error occurs or ctx is done.
+func (t *Metainfo) Seed(ctx context.Context, outPath string) error {
+    return t.download(ctx, outPath, true)
+}
+
+func (t *Metainfo) download(ctx context.Context, outPath string, seed bool) error {
+    layout := t.Layout(outPath)
+    resumePath := t.resumePath(outPath)
+    fresh := !anyFileExists(layout)
+
+    files, err := storage.NewFile(layout)
+    if err != nil {
+        return err
+    }
+    defer files.Close()
+
+    if !fresh {
+        err = t.restore(files, layout, resumePath)
+        if err != nil {
+            return err
+        }
+    }
+
+    torrent := t.p2pTorrent(files)
+    if seed {
+        go func() {
+            select {
+            case <-torrent.Done():
+                log.Println("download complete, seeding...")
+                t.saveResume(files, layout, resumePath)
+            case <-ctx.Done():
+            }
+        }()
+    }
+
+    downloadErr := t.run(ctx, torrent, seed)
+    err = t.saveResume(files, layout, resumePath)
+    if downloadErr != nil {
+        return downloadErr
+    }
     if err != nil {
         return err
     }
+    return files.Close()
+}
+
+func (t *Metainfo) DownloadTo(ctx context.Context, st storage.Storage) error {
+    return t.run(ctx, t.p2pTorrent(st), false)
+}
+
+func (t *Metainfo) run(ctx context.Context, torrent *p2p.Torrent, seed bool) error {
+    if torrent.Complete() && !seed {
+        return nil
+    }
+    if t.Listener != nil {
+        t.Listener.Add(torrent)
+        defer t.Listener.Remove(torrent)
+    }
+
+    a := t.newAnnouncer(ctx, torrent)
+    found, err := a.start()
+    defer a.stop()
+    if t.useDHT() {
+        found = append(found, t.dhtPeers()...)
+        ctx, cancel := context.WithCancel(ctx)
+        defer cancel()
+        go t.runDHT(ctx, torrent)
+    }
+    if t.useLSD() {
+        t.LSD.Add(t.InfoHash, torrent.AddPeers)
+        defer t.LSD.Remove(t.InfoHash)
+    }
+
+    torrent.Peers = uniquePeers(append(found, t.peers...))
+    if seed {
+        return torrent.Seed(ctx)
+    }
+    // peers on the local network may still show up
+    if len(torrent.Peers) == 0 && !t.useLSD() {
+        if err == nil {
+            err = ErrNoPeers
+        }
+        return err
+    }
+    return torrent.Download(ctx)
+}
 
-    torrent := p2p.Torrent{
-        Peers: peers,
+func (t *Metainfo) p2pTorrent(st storage.Storage) *p2p.Torrent {
+    torrent := &p2p.Torrent{
         PeerId: peerId,
         InfoHash: t.InfoHash,
         PieceHashes: t.Info.Pieces,
         PieceLength: t.Info.PieceLength,
         Length: t.getTotalLength(),
         Name: t.Info.Name,
+        Storage: st,
+        Private: t.Info.Private == 1,
+        Metadata: t.infoBytes,
+        Limits: t.Limits,
     }
-
-    fileContents, err := torrent.Download()
-    if err != nil {
-        return err
+    if t.Listener != nil {
+        torrent.Port = t.Listener.Port()
     }
+    return torrent
+}
 
-    f, err := os.Create(outPath)
-    if err != nil {
-        return err
+func (t *Metainfo) port() int64 {
+    if t.Listener != nil {
+        return t.Listener.Port()
     }
-    defer f.Close()
-    _, err = f.Write(fileContents)
-    if err != nil {
-        return err
+    return defaultPort
+}
+
+func newPeerId() string {
+    const chars = "0123456789abcdefghijklmnopqrstuvwxyz"
+    id := []byte("-TJ0001-")
+    for i := 0; i < 12; i++ {
+        id = append(id, chars[rand.IntN(len(chars))])
     }
-    return nil
+    return string(id)
 }
 
 func getField[T any](decoded map[string]any, field string, target *T) {
@@ -131,19 +317,56 @@ func getField[T any](decoded map[string]any, field string, target *T) {
     }
 }
 
-func getAnnounceList(decoded map[string]any) []string {
-    announceList := []string{}
+func getAnnounceList(decoded map[string]any) [][]string {
     list, ok := decoded["announce-list"].([]any)
     if !ok {
         return nil
     }
+    announceList := [][]string{}
     for _, elem := range list {
-        tracker := elem.([]any)[0].(string)
-        announceList = append(announceList, tracker)
+        tierRaw, ok := elem.([]any)
+        if !ok {
+            continue
+        }
+        tier := []string{}
+        for _, trackerRaw := range tierRaw {
+            if tracker, ok := trackerRaw.(string); ok {
+                tier = append(tier, tracker)
+            }
+        }
+        if len(tier) == 0 {
+            continue
+        }
+        rand.Shuffle(len(tier), func(i, j int) {
+            tier[i], tier[j] = tier[j], tier[i]
+        })
+        announceList = append(announceList, tier)
     }
     return announceList
 }
 
+// getNodes reads the "nodes" list of trackerless torrents, made of
+// [host, port] pairs.
+func getNodes(decoded map[string]any) []string {
+    list, ok := decoded["nodes"].([]any)
+    if !ok {
+        return nil
+    }
+    nodes := []string{}
+    for _, elem := range list {
+        pair, ok := elem.([]any)
+        if !ok || len(pair) != 2 {
+            continue
+        }
+        host, ok := pair[0].(string)
+        port, ok2 := pair[1].(int64)
+        if ok && ok2 {
+            nodes = append(nodes, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+        }
+    }
+    return nodes
+}
+
 func getInfo(decoded map[string]any) (info, error) {
     i := info{}
     dataRaw, ok := decoded["info"]
@@ -163,6 +386,9 @@ func getInfo(decoded map[string]any) (info, error) {
     if !ok {
         return info{}, errors.New("failed to parse piece length as int64")
     }
+    if i.PieceLength <= 0 {
+        return info{}, fmt.Errorf("invalid piece length %d", i.PieceLength)
+    }
 
     getField(data, "private", &i.Private)
     pieces, ok := data["pieces"]
@@ -194,6 +420,26 @@ func getInfo(decoded map[string]any) (info, error) {
     if err != nil {
         return info{}, err
     }
+    i.mode = mode
+
+    // every piece but the last is full, so the hashes must match the length
+    var total int64
+    for _, f := range i.Files {
+        if f.Length < 0 {
+            return info{}, fmt.Errorf("invalid file length %d", f.Length)
+        }
+        total += f.Length
+        if total < 0 {
+            return info{}, errors.New("total length of files is too large")
+        }
+    }
+    numPieces := total/i.PieceLength
+    if total % i.PieceLength != 0 {
+        numPieces++
+    }
+    if int64(len(i.Pieces)) != numPieces {
+        return info{}, fmt.Errorf("torrent has %d piece hashes, its length needs %d", len(i.Pieces), numPieces)
+    }
 
     return i, nil
 }
@@ -226,6 +472,9 @@ func getFiles(data map[string]any, mode int, name string) ([]file, error) {
         return f, err
     }
 
+    if _, err := sanitizePath([]string{name}); err != nil {
+        return nil, err
+    }
     files, err := getMultiFile(data)
     return files, err
 }
@@ -287,7 +536,10 @@ func getMultiFile(data map[string]any) ([]file, error) {
             pathList = append(pathList, p)
         }
 
-        path := strings.Join(pathList, "/")
+        path, err := sanitizePath(pathList)
+        if err != nil {
+            return nil, err
+        }
         f := file{}
         f.Length = length
         f.Path = path
@@ -0,0 +1,60 @@
+package torrent
+
+import (
+    "strings"
+    "testing"
+)
+
+func testInfo(pieceLength int64, numPieces int, files ...int64) map[string]any {
+    info := map[string]any{
+        "name": "test",
+        "piece length": pieceLength,
+        "pieces": strings.Repeat("x", 20*numPieces),
+    }
+    if len(files) == 1 {
+        info["length"] = files[0]
+        return map[string]any{"info": info}
+    }
+    list := []any{}
+    for i, length := range files {
+        list = append(list, map[string]any{
+            "length": length,
+            "path": []any{string(rune('a' + i))},
+        })
+    }
+    info["files"] = list
+    return map[string]any{"info": info}
+}
+
+func TestGetInfo(t *testing.T) {
+    cases := map[string]map[string]any{
+        "single file": testInfo(16, 1, 10),
+        "exact multiple": testInfo(16, 2, 32),
+        "multiple files": testInfo(16, 3, 10, 20, 5),
+        "empty": testInfo(16, 0, 0),
+    }
+    for name, decoded := range cases {
+        _, err := getInfo(decoded)
+        if err != nil {
+            t.Errorf("%s: %v", name, err)
+        }
+    }
+}
+
+func TestGetInfoInvalid(t *testing.T) {
+    cases := map[string]map[string]any{
+        "zero piece length": testInfo(0, 1, 10),
+        "negative piece length": testInfo(-16, 1, 10),
+        "negative file length": testInfo(16, 1, -10),
+        "negative file among others": testInfo(16, 1, 20, -10),
+        "too many hashes": testInfo(16, 2, 10),
+        "too few hashes": testInfo(16, 1, 17),
+        "hashes for an empty torrent": testInfo(16, 1, 0),
+    }
+    for name, decoded := range cases {
+        _, err := getInfo(decoded)
+        if err == nil {
+            t.Errorf("%s: expected an error", name)
+        }
+    }
+}
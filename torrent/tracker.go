@@ -1,30 +1,65 @@
 package torrent
 
 import (
+    "context"
     "errors"
+    "fmt"
     "io"
+    "log"
     "net"
     "net/http"
     "net/url"
     "strconv"
+    "sync"
     "time"
 
     "github.com/lauchimoon/torreja/bencode"
     "github.com/lauchimoon/torreja/peers"
 )
 
-func (m *Metainfo) buildTrackerURL(peerId string, port int64) (string, error) {
-    base, err := url.Parse(m.Announce)
+const defaultInterval = 30*time.Minute
+
+// lower bound on the announce interval, whatever trackers ask for
+const minAnnounceInterval = time.Minute
+
+type announceRequest struct {
+    PeerId     string
+    Port       int64
+    Uploaded   int64
+    Downloaded int64
+    Left       int64
+    // "started", "completed", "stopped" or empty for regular announces
+    Event      string
+    TrackerId  string
+}
+
+type announceResponse struct {
+    Peers       []peers.Peer
+    Interval    time.Duration
+    MinInterval time.Duration
+    TrackerId   string
+    Complete    int64
+    Incomplete  int64
+}
+
+func (m *Metainfo) buildTrackerURL(announce string, req announceRequest) (string, error) {
+    base, err := url.Parse(announce)
     if err != nil {
         return "", err
     }
-    params := url.Values{
-        "info_hash": []string{string(m.InfoHash[:])},
-        "peer_id": []string{peerId},
-        "port": []string{strconv.FormatInt(port, 10)},
-        "uploaded": []string{"0"},
-        "downloaded": []string{"0"},
-        "left": []string{strconv.FormatInt(m.getTotalLength(), 10)},
+    params := base.Query()
+    params.Set("info_hash", string(m.InfoHash[:]))
+    params.Set("peer_id", req.PeerId)
+    params.Set("port", strconv.FormatInt(req.Port, 10))
+    params.Set("uploaded", strconv.FormatInt(req.Uploaded, 10))
+    params.Set("downloaded", strconv.FormatInt(req.Downloaded, 10))
+    params.Set("left", strconv.FormatInt(req.Left, 10))
+    params.Set("compact", "1")
+    if req.Event != "" {
+        params.Set("event", req.Event)
+    }
+    if req.TrackerId != "" {
+        params.Set("trackerid", req.TrackerId)
     }
     base.RawQuery = params.Encode()
     return base.String(), nil
@@ -38,14 +73,164 @@ func (m *Metainfo) getTotalLength() int64 {
     return length
 }
 
-func (m *Metainfo) RequestPeers(peerId string, port int64) ([]peers.Peer, error) {
-    url, err := m.buildTrackerURL(peerId, port)
+func (m *Metainfo) RequestPeers(ctx context.Context, peerId string, port int64) ([]peers.Peer, error) {
+    res, err := m.announce(ctx, m.Announce, m.initialRequest(peerId, port))
     if err != nil {
         return nil, err
     }
+    return res.Peers, nil
+}
 
-    client := &http.Client{Timeout: 15*time.Second}
-    resp, err := client.Get(url)
+func (m *Metainfo) initialRequest(peerId string, port int64) announceRequest {
+    left := m.getTotalLength()
+    // without the info we have nothing, but trackers take left=0 for a
+    // seed and may leave other seeds out of the peers they send
+    if m.Info.Files == nil {
+        left = max(m.magnetLength, 1)
+    }
+    return announceRequest{
+        PeerId: peerId,
+        Port: port,
+        Left: left,
+    }
+}
+
+func (m *Metainfo) announce(ctx context.Context, announce string, req announceRequest) (*announceResponse, error) {
+    u, err := url.Parse(announce)
+    if err != nil {
+        return nil, err
+    }
+    switch u.Scheme {
+    case "udp":
+        return m.announceUDP(ctx, announce, req)
+    case "http", "https":
+        return m.announceHTTP(ctx, announce, req)
+    }
+    return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+}
+
+// announceTiers announces to one tracker of every tier (BEP 12) and
+// combines the peers they return. Tiers are announced to at the same time
+// so that a dead tracker only holds up its own tier. Within a tier
+// trackers are tried in order, and the one that answers is moved to the
+// front for next time. It also returns how long to wait before the next
+// announce. trackerIds, if not nil, keeps the tracker id each tracker gave
+// us.
+func (m *Metainfo) announceTiers(ctx context.Context, req announceRequest, trackerIds map[string]string) ([]peers.Peer, time.Duration, error) {
+    tiers := m.tiers()
+    responses := make([]*announceResponse, len(tiers))
+    errs := make([]error, len(tiers))
+    // guards trackerIds
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    for t, tier := range tiers {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            req := req
+            for i, tracker := range tier {
+                if ctx.Err() != nil {
+                    errs[t] = ctx.Err()
+                    return
+                }
+                mu.Lock()
+                req.TrackerId = trackerIds[tracker]
+                mu.Unlock()
+                res, err := m.announce(ctx, tracker, req)
+                if err != nil {
+                    errs[t] = err
+                    continue
+                }
+                copy(tier[1:i+1], tier[:i])
+                tier[0] = tracker
+                if trackerIds != nil && res.TrackerId != "" {
+                    mu.Lock()
+                    trackerIds[tracker] = res.TrackerId
+                    mu.Unlock()
+                }
+                responses[t] = res
+                return
+            }
+        }()
+    }
+    wg.Wait()
+    if ctx.Err() != nil {
+        return nil, 0, ctx.Err()
+    }
+
+    peerList := []peers.Peer{}
+    var interval, minInterval time.Duration
+    var lastErr error
+    answered := false
+    for t, res := range responses {
+        if res == nil {
+            if errs[t] != nil {
+                lastErr = errs[t]
+            }
+            continue
+        }
+        peerList = append(peerList, res.Peers...)
+        if !answered || res.Interval < interval {
+            interval = res.Interval
+        }
+        minInterval = max(minInterval, res.MinInterval)
+        answered = true
+    }
+
+    if !answered {
+        if lastErr == nil {
+            lastErr = errors.New("no trackers to announce to")
+        }
+        return nil, 0, lastErr
+    }
+    return uniquePeers(peerList), max(interval, minInterval, minAnnounceInterval), nil
+}
+
+// findPeers asks every tier for peers once, without sending an event.
+func (m *Metainfo) findPeers(ctx context.Context) ([]peers.Peer, error) {
+    found, _, err := m.announceTiers(ctx, m.initialRequest(peerId, m.port()), nil)
+    if m.useDHT() {
+        found = append(found, m.dhtPeers()...)
+    }
+    peerList := uniquePeers(append(found, m.peers...))
+    if len(peerList) == 0 {
+        if err != nil {
+            return nil, err
+        }
+        return nil, ErrNoPeers
+    }
+    return peerList, nil
+}
+
+func (m *Metainfo) tiers() [][]string {
+    if len(m.AnnounceList) > 0 {
+        return m.AnnounceList
+    }
+    if m.Announce != "" {
+        return [][]string{{m.Announce}}
+    }
+    return nil
+}
+
+func uniquePeers(list []peers.Peer) []peers.Peer {
+    seen := make(map[string]bool)
+    unique := []peers.Peer{}
+    for _, peer := range list {
+        if !seen[peer.String()] {
+            seen[peer.String()] = true
+            unique = append(unique, peer)
+        }
+    }
+    return unique
+}
+
+func (m *Metainfo) announceHTTP(ctx context.Context, announce string, req announceRequest) (*announceResponse, error) {
+    url, err := m.buildTrackerURL(announce, req)
+    if err != nil {
+        return nil, err
+    }
+
+    resp, err := httpGet(ctx, url)
     if err != nil {
         return nil, err
     }
@@ -63,7 +248,40 @@ func (m *Metainfo) RequestPeers(peerId string, port int64) ([]peers.Peer, error)
     if err != nil {
         return nil, err
     }
-    return parsePeers(decoded)
+    if warning, ok := decoded["warning message"].(string); ok {
+        log.Printf("tracker %s: %s", announce, warning)
+    }
+
+    res := &announceResponse{Interval: defaultInterval}
+    var interval, minInterval int64
+    getField(decoded, "interval", &interval)
+    getField(decoded, "min interval", &minInterval)
+    getField(decoded, "tracker id", &res.TrackerId)
+    getField(decoded, "complete", &res.Complete)
+    getField(decoded, "incomplete", &res.Incomplete)
+    if interval > 0 {
+        res.Interval = time.Duration(interval)*time.Second
+    }
+    res.MinInterval = time.Duration(minInterval)*time.Second
+
+    // A stopped announce does not need any peers back.
+    if req.Event == "stopped" {
+        return res, nil
+    }
+    res.Peers, err = parsePeers(decoded)
+    if err != nil {
+        return nil, err
+    }
+    return res, nil
+}
+
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return nil, err
+    }
+    client := &http.Client{Timeout: 15*time.Second}
+    return client.Do(req)
 }
 
 func checkFailure(decoded map[string]any) error {
@@ -78,27 +296,87 @@ func checkFailure(decoded map[string]any) error {
     return errors.New(reasonString)
 }
 
+var ErrNoPeers = errors.New("failed to find peers to connect to")
+
+// PeerListError is returned when the peers in a tracker response are
+// malformed. Index is -1 when the whole field is at fault.
+type PeerListError struct {
+    Field  string
+    Index  int
+    Reason string
+}
+
+func (e *PeerListError) Error() string {
+    if e.Index < 0 {
+        return fmt.Sprintf("malformed '%s' in tracker response: %s", e.Field, e.Reason)
+    }
+    return fmt.Sprintf("malformed peer %d in '%s' of tracker response: %s", e.Index, e.Field, e.Reason)
+}
+
 func parsePeers(decoded map[string]any) ([]peers.Peer, error) {
-    peersRaw, ok := decoded["peers"]
-    if !ok {
-        return nil, errors.New("failed to find peers to connect to")
+    peersRaw, hasPeers := decoded["peers"]
+    peers6Raw, hasPeers6 := decoded["peers6"]
+    if !hasPeers && !hasPeers6 {
+        return nil, ErrNoPeers
     }
-    peersList, ok := peersRaw.([]any)
-    if !ok {
-        return nil, errors.New("failed to parse peers as list")
+
+    list := []peers.Peer{}
+    if hasPeers {
+        found, err := parsePeerField("peers", peersRaw, peers.Unmarshal)
+        if err != nil {
+            return nil, err
+        }
+        list = append(list, found...)
     }
+    if hasPeers6 {
+        found, err := parsePeerField("peers6", peers6Raw, peers.Unmarshal6)
+        if err != nil {
+            return nil, err
+        }
+        list = append(list, found...)
+    }
+    return list, nil
+}
+
+// parsePeerField accepts both the compact string (BEP 23) and the original
+// list of dictionaries.
+func parsePeerField(field string, raw any, unmarshal func([]byte) ([]peers.Peer, error)) ([]peers.Peer, error) {
+    switch value := raw.(type) {
+    case string:
+        list, err := unmarshal([]byte(value))
+        if err != nil {
+            return nil, &PeerListError{field, -1, err.Error()}
+        }
+        return list, nil
+    case []any:
+        return parsePeerDicts(field, value)
+    }
+    return nil, &PeerListError{field, -1, "expected string or list"}
+}
 
+func parsePeerDicts(field string, peersList []any) ([]peers.Peer, error) {
     list := []peers.Peer{}
-    for _, peerRaw := range peersList {
+    for i, peerRaw := range peersList {
         peer, ok := peerRaw.(map[string]any)
         if !ok {
-            return nil, errors.New("failed to parse peer as dictionary")
+            return nil, &PeerListError{field, i, "expected dictionary"}
+        }
+        ipString, ok := peer["ip"].(string)
+        if !ok {
+            return nil, &PeerListError{field, i, "missing or invalid 'ip'"}
+        }
+        ip := net.ParseIP(ipString)
+        if ip == nil {
+            return nil, &PeerListError{field, i, fmt.Sprintf("invalid ip %q", ipString)}
+        }
+        port, ok := peer["port"].(int64)
+        if !ok || port <= 0 || port > 65535 {
+            return nil, &PeerListError{field, i, "missing or invalid 'port'"}
         }
         list = append(list, peers.Peer{
-            Ip: net.ParseIP(peer["ip"].(string)),
-            Port: peer["port"].(int64),
+            Ip: ip,
+            Port: port,
         })
     }
-
     return list, nil
 }
@@ -0,0 +1,53 @@
+package torrent
+
+import (
+    "context"
+    "testing"
+)
+
+func TestAnnounceTiers(t *testing.T) {
+    failing := newUDPTestTracker(t)
+    failing.failure = "tracker is down"
+    first := newUDPTestTracker(t)
+    second := newUDPTestTracker(t)
+    second.peers = []byte{10, 0, 0, 3, 0x1a, 0xe3}
+
+    down, up := failing.start(t), first.start(t)
+    m := &Metainfo{AnnounceList: [][]string{{down, up}, {second.start(t)}}}
+    found, _, err := m.announceTiers(context.Background(), announceRequest{PeerId: peerId}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    want := map[string]bool{"10.0.0.1:6881": true, "10.0.0.2:6882": true, "10.0.0.3:6883": true}
+    if len(found) != len(want) {
+        t.Fatalf("got peers %v, want 3 peers from both tiers", found)
+    }
+    for _, peer := range found {
+        if !want[peer.String()] {
+            t.Errorf("unexpected peer %s", peer)
+        }
+    }
+    // the tracker that answered is tried first next time
+    if m.AnnounceList[0][0] != up || m.AnnounceList[0][1] != down {
+        t.Errorf("first tier is %v after failing over", m.AnnounceList[0])
+    }
+}
+
+func TestInitialRequestLeft(t *testing.T) {
+    cases := []struct {
+        name string
+        m    *Metainfo
+        want int64
+    }{
+        {"magnet without xl", &Metainfo{}, 1},
+        {"magnet with xl", &Metainfo{magnetLength: 12345}, 12345},
+        {"with info", &Metainfo{Info: info{Files: []file{{Length: 10}, {Length: 20}}}}, 30},
+    }
+    for _, c := range cases {
+        req := c.m.initialRequest(peerId, 6881)
+        if req.Left != c.want {
+            t.Errorf("%s: left is %d, want %d", c.name, req.Left, c.want)
+        }
+    }
+}
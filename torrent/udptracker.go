@@ -0,0 +1,275 @@
+package torrent
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math/rand/v2"
+    "net"
+    "net/url"
+    "sync"
+    "time"
+
+    "github.com/lauchimoon/torreja/peers"
+)
+
+// UDP tracker protocol, BEP 15.
+
+const udpProtocolId = 0x41727101980
+
+const (
+    udpActionConnect = iota
+    udpActionAnnounce
+    udpActionScrape
+    udpActionError
+)
+
+const (
+    udpEventNone = iota
+    udpEventCompleted
+    udpEventStarted
+    udpEventStopped
+)
+
+// A connection id may be used for one minute after it was received.
+const udpConnectionIdTTL = time.Minute
+// Requests are retransmitted after 15 * 2^n seconds. BEP 15 goes up to
+// n = 8, but that would keep us waiting for an hour before failing over to
+// the next tracker.
+const udpBaseTimeout = 15*time.Second
+const udpMaxRetries = 2
+
+type udpConnectionId struct {
+    id       uint64
+    received time.Time
+}
+
+var udpConnectionIds = struct {
+    sync.Mutex
+    ids map[string]udpConnectionId
+}{ids: make(map[string]udpConnectionId)}
+
+var udpKey = rand.Uint32()
+
+type udpTracker struct {
+    conn *net.UDPConn
+    host string
+    ctx  context.Context
+    // unregisters cutting reads short when ctx is done
+    stop func() bool
+}
+
+func dialUDPTracker(ctx context.Context, announce string) (*udpTracker, error) {
+    u, err := url.Parse(announce)
+    if err != nil {
+        return nil, err
+    }
+    if u.Scheme != "udp" {
+        return nil, fmt.Errorf("expected udp tracker, got %q", u.Scheme)
+    }
+    var dialer net.Dialer
+    conn, err := dialer.DialContext(ctx, "udp", u.Host)
+    if err != nil {
+        return nil, err
+    }
+    udpConn := conn.(*net.UDPConn)
+    // a deadline in the past wakes up a read in progress
+    stop := context.AfterFunc(ctx, func() {
+        udpConn.SetReadDeadline(time.Now())
+    })
+    return &udpTracker{udpConn, u.Host, ctx, stop}, nil
+}
+
+func (u *udpTracker) Close() error {
+    u.stop()
+    return u.conn.Close()
+}
+
+func (u *udpTracker) isIPv6() bool {
+    addr := u.conn.RemoteAddr().(*net.UDPAddr)
+    return addr.IP.To4() == nil
+}
+
+// connectionId returns a connection id that has not expired yet, asking
+// the tracker for a new one if needed.
+func (u *udpTracker) connectionId() (uint64, error) {
+    udpConnectionIds.Lock()
+    cached, ok := udpConnectionIds.ids[u.host]
+    udpConnectionIds.Unlock()
+    if ok && time.Since(cached.received) < udpConnectionIdTTL {
+        return cached.id, nil
+    }
+
+    res, err := u.roundTrip(udpActionConnect, 16, func(transactionId uint32) ([]byte, error) {
+        buf := make([]byte, 16)
+        binary.BigEndian.PutUint64(buf[0:8], udpProtocolId)
+        binary.BigEndian.PutUint32(buf[8:12], udpActionConnect)
+        binary.BigEndian.PutUint32(buf[12:16], transactionId)
+        return buf, nil
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    id := binary.BigEndian.Uint64(res[8:16])
+    udpConnectionIds.Lock()
+    udpConnectionIds.ids[u.host] = udpConnectionId{id, time.Now()}
+    udpConnectionIds.Unlock()
+    return id, nil
+}
+
+// roundTrip sends the request built by build and waits for the response
+// with the same transaction id, retransmitting with backoff. build is
+// called again for every attempt so that expired connection ids are
+// refreshed.
+func (u *udpTracker) roundTrip(action uint32, minLen int, build func(transactionId uint32) ([]byte, error)) ([]byte, error) {
+    buf := make([]byte, 65536)
+    for n := 0; n <= udpMaxRetries; n++ {
+        transactionId := rand.Uint32()
+        req, err := build(transactionId)
+        if err != nil {
+            return nil, err
+        }
+        _, err = u.conn.Write(req)
+        if err != nil {
+            return nil, err
+        }
+
+        u.conn.SetReadDeadline(time.Now().Add(udpBaseTimeout << n))
+        // the deadline set when ctx was done may have just been replaced
+        if u.ctx.Err() != nil {
+            return nil, u.ctx.Err()
+        }
+        for {
+            size, err := u.conn.Read(buf)
+            if err != nil {
+                if u.ctx.Err() != nil {
+                    return nil, u.ctx.Err()
+                }
+                var netErr net.Error
+                if errors.As(err, &netErr) && netErr.Timeout() {
+                    break
+                }
+                return nil, err
+            }
+            if size < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionId {
+                continue
+            }
+
+            res := buf[:size]
+            switch binary.BigEndian.Uint32(res[0:4]) {
+            case udpActionError:
+                return nil, errors.New(string(res[8:]))
+            case action:
+                if size < minLen {
+                    return nil, fmt.Errorf("tracker response is too short (%d bytes)", size)
+                }
+                return res, nil
+            default:
+                return nil, fmt.Errorf("unexpected tracker action %d", binary.BigEndian.Uint32(res[0:4]))
+            }
+        }
+    }
+    return nil, fmt.Errorf("tracker %s did not respond", u.host)
+}
+
+var udpEvents = map[string]uint32{
+    "": udpEventNone,
+    "completed": udpEventCompleted,
+    "started": udpEventStarted,
+    "stopped": udpEventStopped,
+}
+
+func (m *Metainfo) announceUDP(ctx context.Context, announce string, req announceRequest) (*announceResponse, error) {
+    tracker, err := dialUDPTracker(ctx, announce)
+    if err != nil {
+        return nil, err
+    }
+    defer tracker.Close()
+
+    res, err := tracker.roundTrip(udpActionAnnounce, 20, func(transactionId uint32) ([]byte, error) {
+        connectionId, err := tracker.connectionId()
+        if err != nil {
+            return nil, err
+        }
+        buf := make([]byte, 98)
+        binary.BigEndian.PutUint64(buf[0:8], connectionId)
+        binary.BigEndian.PutUint32(buf[8:12], udpActionAnnounce)
+        binary.BigEndian.PutUint32(buf[12:16], transactionId)
+        copy(buf[16:36], m.InfoHash[:])
+        copy(buf[36:56], req.PeerId)
+        binary.BigEndian.PutUint64(buf[56:64], uint64(req.Downloaded))
+        binary.BigEndian.PutUint64(buf[64:72], uint64(req.Left))
+        binary.BigEndian.PutUint64(buf[72:80], uint64(req.Uploaded))
+        binary.BigEndian.PutUint32(buf[80:84], udpEvents[req.Event])
+        binary.BigEndian.PutUint32(buf[84:88], 0)
+        binary.BigEndian.PutUint32(buf[88:92], udpKey)
+        binary.BigEndian.PutUint32(buf[92:96], 0xffffffff)
+        binary.BigEndian.PutUint16(buf[96:98], uint16(req.Port))
+        return buf, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    announceRes := &announceResponse{
+        Interval: defaultInterval,
+        Incomplete: int64(binary.BigEndian.Uint32(res[12:16])),
+        Complete: int64(binary.BigEndian.Uint32(res[16:20])),
+    }
+    interval := binary.BigEndian.Uint32(res[8:12])
+    if interval > 0 {
+        announceRes.Interval = time.Duration(interval)*time.Second
+    }
+    if tracker.isIPv6() {
+        announceRes.Peers, err = peers.Unmarshal6(res[20:])
+    } else {
+        announceRes.Peers, err = peers.Unmarshal(res[20:])
+    }
+    if err != nil {
+        return nil, err
+    }
+    return announceRes, nil
+}
+
+func scrapeUDP(ctx context.Context, announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+    // 74 info hashes are all that fit in one packet
+    if len(infoHashes) > 74 {
+        return nil, fmt.Errorf("cannot scrape %d info hashes at once over udp", len(infoHashes))
+    }
+    tracker, err := dialUDPTracker(ctx, announce)
+    if err != nil {
+        return nil, err
+    }
+    defer tracker.Close()
+
+    res, err := tracker.roundTrip(udpActionScrape, 8+12*len(infoHashes), func(transactionId uint32) ([]byte, error) {
+        connectionId, err := tracker.connectionId()
+        if err != nil {
+            return nil, err
+        }
+        buf := make([]byte, 16+20*len(infoHashes))
+        binary.BigEndian.PutUint64(buf[0:8], connectionId)
+        binary.BigEndian.PutUint32(buf[8:12], udpActionScrape)
+        binary.BigEndian.PutUint32(buf[12:16], transactionId)
+        for i, infoHash := range infoHashes {
+            copy(buf[16+20*i:], infoHash[:])
+        }
+        return buf, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    results := make(map[[20]byte]ScrapeResult)
+    for i, infoHash := range infoHashes {
+        stats := res[8+12*i:]
+        results[infoHash] = ScrapeResult{
+            Complete: int64(binary.BigEndian.Uint32(stats[0:4])),
+            Downloaded: int64(binary.BigEndian.Uint32(stats[4:8])),
+            Incomplete: int64(binary.BigEndian.Uint32(stats[8:12])),
+        }
+    }
+    return results, nil
+}
@@ -0,0 +1,215 @@
+package torrent
+
+import (
+    "context"
+    "encoding/binary"
+    "net"
+    "testing"
+    "time"
+)
+
+// udpTestTracker is a stand-in UDP tracker on the loopback interface. It
+// hands out one connection id and answers announces and scrapes with fixed
+// values, passing every announce it receives on to the test.
+type udpTestTracker struct {
+    conn     *net.UDPConn
+    interval uint32
+    peers    []byte
+    // answer announces with an error instead
+    failure  string
+    // drop every packet
+    silent   bool
+
+    announces chan []byte
+}
+
+const udpTestConnectionId = 0x1122334455667788
+
+func newUDPTestTracker(t *testing.T) *udpTestTracker {
+    conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    tr := &udpTestTracker{
+        conn: conn,
+        interval: 1800,
+        peers: []byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2},
+        announces: make(chan []byte, 16),
+    }
+    t.Cleanup(func() { conn.Close() })
+    return tr
+}
+
+// start answers requests from now on and returns the tracker's announce
+// url. Fields must not be changed afterwards.
+func (tr *udpTestTracker) start(t *testing.T) string {
+    go tr.serve(t)
+    return "udp://" + tr.conn.LocalAddr().String() + "/announce"
+}
+
+func (tr *udpTestTracker) serve(t *testing.T) {
+    buf := make([]byte, 65536)
+    for {
+        size, addr, err := tr.conn.ReadFromUDP(buf)
+        if err != nil {
+            return
+        }
+        if tr.silent || size < 16 {
+            continue
+        }
+        req := append([]byte{}, buf[:size]...)
+        action := binary.BigEndian.Uint32(req[8:12])
+        transactionId := req[12:16]
+
+        res := []byte{}
+        switch action {
+        case udpActionConnect:
+            if binary.BigEndian.Uint64(req[0:8]) != udpProtocolId {
+                t.Errorf("connect has protocol id %x", req[0:8])
+                continue
+            }
+            res = binary.BigEndian.AppendUint32(res, udpActionConnect)
+            res = append(res, transactionId...)
+            res = binary.BigEndian.AppendUint64(res, udpTestConnectionId)
+        case udpActionAnnounce, udpActionScrape:
+            if binary.BigEndian.Uint64(req[0:8]) != udpTestConnectionId {
+                t.Errorf("request has connection id %x", req[0:8])
+                continue
+            }
+            if tr.failure != "" {
+                res = binary.BigEndian.AppendUint32(res, udpActionError)
+                res = append(res, transactionId...)
+                res = append(res, tr.failure...)
+                break
+            }
+            res = binary.BigEndian.AppendUint32(res, action)
+            res = append(res, transactionId...)
+            if action == udpActionAnnounce {
+                tr.announces <- req
+                res = binary.BigEndian.AppendUint32(res, tr.interval)
+                res = binary.BigEndian.AppendUint32(res, 3)
+                res = binary.BigEndian.AppendUint32(res, 7)
+                res = append(res, tr.peers...)
+                break
+            }
+            for i := 16; i+20 <= size; i += 20 {
+                res = binary.BigEndian.AppendUint32(res, uint32(req[i]))
+                res = binary.BigEndian.AppendUint32(res, 100)
+                res = binary.BigEndian.AppendUint32(res, 5)
+            }
+        }
+        tr.conn.WriteToUDP(res, addr)
+    }
+}
+
+func TestAnnounceUDP(t *testing.T) {
+    tr := newUDPTestTracker(t)
+    announce := tr.start(t)
+    m := &Metainfo{InfoHash: [20]byte{0xab, 0xcd}}
+    req := announceRequest{
+        PeerId: "-TR0001-abcdefghijkl",
+        Port: 6881,
+        Uploaded: 10,
+        Downloaded: 20,
+        Left: 30,
+        Event: "started",
+    }
+    res, err := m.announceUDP(context.Background(), announce, req)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    sent := <-tr.announces
+    if len(sent) != 98 {
+        t.Fatalf("announce is %d bytes, want 98", len(sent))
+    }
+    if string(sent[16:36]) != string(m.InfoHash[:]) {
+        t.Errorf("announced info hash %x", sent[16:36])
+    }
+    if string(sent[36:56]) != req.PeerId {
+        t.Errorf("announced peer id %q", sent[36:56])
+    }
+    downloaded := binary.BigEndian.Uint64(sent[56:64])
+    left := binary.BigEndian.Uint64(sent[64:72])
+    uploaded := binary.BigEndian.Uint64(sent[72:80])
+    if downloaded != 20 || left != 30 || uploaded != 10 {
+        t.Errorf("announced downloaded %d, left %d, uploaded %d", downloaded, left, uploaded)
+    }
+    if event := binary.BigEndian.Uint32(sent[80:84]); event != udpEventStarted {
+        t.Errorf("announced event %d, want %d", event, udpEventStarted)
+    }
+    if port := binary.BigEndian.Uint16(sent[96:98]); port != 6881 {
+        t.Errorf("announced port %d", port)
+    }
+
+    if res.Interval != 30*time.Minute {
+        t.Errorf("got interval %s, want 30m", res.Interval)
+    }
+    if res.Incomplete != 3 || res.Complete != 7 {
+        t.Errorf("got %d leechers and %d seeders, want 3 and 7", res.Incomplete, res.Complete)
+    }
+    if len(res.Peers) != 2 || res.Peers[0].String() != "10.0.0.1:6881" || res.Peers[1].String() != "10.0.0.2:6882" {
+        t.Errorf("got peers %v", res.Peers)
+    }
+}
+
+func TestAnnounceUDPZeroInterval(t *testing.T) {
+    tr := newUDPTestTracker(t)
+    tr.interval = 0
+    m := &Metainfo{Announce: tr.start(t)}
+
+    _, interval, err := m.announceTiers(context.Background(), announceRequest{PeerId: peerId}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if interval != defaultInterval {
+        t.Errorf("got interval %s, want %s", interval, defaultInterval)
+    }
+}
+
+func TestAnnounceUDPError(t *testing.T) {
+    tr := newUDPTestTracker(t)
+    tr.failure = "torrent not registered"
+    announce := tr.start(t)
+    m := &Metainfo{}
+
+    _, err := m.announceUDP(context.Background(), announce, announceRequest{PeerId: peerId})
+    if err == nil || err.Error() != tr.failure {
+        t.Fatalf("got error %v, want %q", err, tr.failure)
+    }
+}
+
+func TestAnnounceUDPCancel(t *testing.T) {
+    tr := newUDPTestTracker(t)
+    tr.silent = true
+    announce := tr.start(t)
+    m := &Metainfo{}
+
+    ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    _, err := m.announceUDP(ctx, announce, announceRequest{PeerId: peerId})
+    if err != context.DeadlineExceeded {
+        t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+    }
+    if elapsed := time.Since(start); elapsed > 5*time.Second {
+        t.Errorf("announce took %s to notice the context was done", elapsed)
+    }
+}
+
+func TestScrapeUDP(t *testing.T) {
+    tr := newUDPTestTracker(t)
+    announce := tr.start(t)
+    infoHashes := [][20]byte{{1}, {2}}
+
+    results, err := scrapeUDP(context.Background(), announce, infoHashes)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, infoHash := range infoHashes {
+        want := ScrapeResult{Complete: int64(infoHash[0]), Downloaded: 100, Incomplete: 5}
+        if results[infoHash] != want {
+            t.Errorf("%x: got %+v, want %+v", infoHash, results[infoHash], want)
+        }
+    }
+}
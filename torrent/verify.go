@@ -0,0 +1,47 @@
+package torrent
+
+import (
+    "runtime"
+
+    "github.com/lauchimoon/torreja/storage"
+)
+
+type VerifyReport struct {
+    NumPieces int
+    BadPieces []int
+    // files that overlap at least one bad piece
+    BadFiles  []string
+}
+
+func (r *VerifyReport) Ok() bool {
+    return len(r.BadPieces) == 0
+}
+
+// Verify checks the data at outPath against the piece hashes without
+// writing anything or touching the network.
+func (t *Metainfo) Verify(outPath string) (*VerifyReport, error) {
+    layout := t.Layout(outPath)
+    files, err := storage.OpenFile(layout)
+    if err != nil {
+        return nil, err
+    }
+    defer files.Close()
+
+    report := &VerifyReport{NumPieces: len(t.Info.Pieces)}
+    report.BadPieces = t.p2pTorrent(files).Verify(runtime.NumCPU())
+
+    var fileStart int64
+    for _, f := range layout.Files {
+        fileEnd := fileStart + f.Length
+        for _, idx := range report.BadPieces {
+            pieceStart := int64(idx)*t.Info.PieceLength
+            pieceEnd := pieceStart + t.Info.PieceLength
+            if pieceStart < fileEnd && fileStart < pieceEnd {
+                report.BadFiles = append(report.BadFiles, f.Path)
+                break
+            }
+        }
+        fileStart = fileEnd
+    }
+    return report, nil
+}